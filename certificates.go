@@ -0,0 +1,131 @@
+// Package main contains utilities for detecting and summarising certificates and private keys in collected content
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// pemBlockPattern matches a complete PEM block.  Go's regex engine doesn't support back-references, so we can't insist
+// that the BEGIN and END labels match, but in practice they always do.
+var pemBlockPattern = regexp.MustCompile(`-----BEGIN ([A-Z0-9 ]+)-----(?s:.*?)-----END [A-Z0-9 ]+-----`)
+
+// certificateSummaryTime is the format used for validity dates in certificate summaries
+const certificateSummaryTime = "2006-01-02T15:04:05Z"
+
+// normalisePEMBlock converts a PEM block that has been embedded in a JSON string or log line (with literal "\n"
+// sequences rather than newlines) back into a form that can be decoded.
+func normalisePEMBlock(block string) string {
+	normalised := strings.ReplaceAll(block, `\r\n`, "\n")
+	normalised = strings.ReplaceAll(normalised, `\n`, "\n")
+	normalised = strings.ReplaceAll(normalised, "\r\n", "\n")
+	return normalised
+}
+
+// describePublicKey returns a short description of a certificate's public key, e.g. "RSA-2048" or "ECDSA-P-256"
+func describePublicKey(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+// describeIssuer returns the issuer's common name, organisation and country, e.g. "R3 / Let's Encrypt / US".  A
+// self-signed certificate's issuer is its own subject, so we don't repeat the name that the summary hashes.
+func describeIssuer(cert *x509.Certificate) string {
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return "self-signed"
+	}
+
+	parts := []string{cert.Issuer.CommonName}
+	parts = append(parts, cert.Issuer.Organization...)
+	parts = append(parts, cert.Issuer.Country...)
+
+	var nonEmpty []string
+	for _, part := range parts {
+		part = strings.TrimSpace(strings.NewReplacer(`"`, "", ";", ",").Replace(part))
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return "unknown"
+	}
+	return strings.Join(nonEmpty, " / ")
+}
+
+// summariseCertificate produces a single-line summary of a certificate that retains the details needed to diagnose
+// expiry and trust problems (issuer, validity dates and key type), whilst replacing the subject CN with a hash.
+func summariseCertificate(cert *x509.Certificate) string {
+	status := "valid"
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		status = "EXPIRED"
+	} else if now.Before(cert.NotBefore) {
+		status = "NOT YET VALID"
+	}
+
+	// The summary may end up inside a JSON string or a log line, so we avoid quotes, and we describe the issuer
+	// in a form that won't be mistaken for an LDAP DN (and masked) later in the obfuscation process.
+	return fmt.Sprintf("[CERTIFICATE REMOVED; subject_cn_hash=%s; issuer=%s; not_before=%s; not_after=%s; key_type=%s; status=%s]",
+		generateConsistentHash(cert.Subject.CommonName),
+		describeIssuer(cert),
+		cert.NotBefore.UTC().Format(certificateSummaryTime),
+		cert.NotAfter.UTC().Format(certificateSummaryTime),
+		describePublicKey(cert),
+		status)
+}
+
+// obfuscatePEMBlocks finds PEM blocks in the content and replaces them.  Private keys are removed outright, certificates
+// are replaced with a summary (see summariseCertificate) and anything else (CSRs, public keys, etc.) is replaced
+// with a hash so that it can still be matched up across files.
+func obfuscatePEMBlocks(content string) string {
+	return pemBlockPattern.ReplaceAllStringFunc(content, func(block string) string {
+		blockType := pemBlockPattern.FindStringSubmatch(block)[1]
+
+		if strings.Contains(blockType, "PRIVATE KEY") {
+			return "[" + blockType + " REMOVED]"
+		}
+
+		if blockType == "CERTIFICATE" || blockType == "TRUSTED CERTIFICATE" {
+			decoded, _ := pem.Decode([]byte(normalisePEMBlock(block)))
+			if decoded != nil {
+				if cert, err := x509.ParseCertificate(decoded.Bytes); err == nil {
+					return summariseCertificate(cert)
+				}
+			}
+			DebugPrint("Unable to parse PEM certificate - removing it without a summary")
+		}
+
+		return fmt.Sprintf("[%s REMOVED; hash=%s]", blockType, generateConsistentHash(block))
+	})
+}
+
+// summariseBase64Certificate attempts to summarise a bare base64-encoded DER certificate, as found in SAML metadata.
+// It returns false if the content isn't a certificate we can parse.
+func summariseBase64Certificate(encoded string) (string, bool) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", false
+	}
+	return summariseCertificate(cert), true
+}
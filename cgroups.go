@@ -0,0 +1,357 @@
+// Package main contains the cgroup collector, which reports the resource limits imposed on Mattermost
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupArea is the area name used for summary findings relating to cgroup limits
+const cgroupArea = "cgroups"
+
+const (
+	// cgroupRoot is where the cgroup filesystems are mounted
+	cgroupRoot = "/sys/fs/cgroup"
+	// minimumMemoryBytes is the smallest amount of memory Mattermost's documentation supports for a deployment
+	minimumMemoryBytes = 2 * 1024 * 1024 * 1024
+	// minimumCPUs is the smallest CPU allocation Mattermost's documentation supports for a deployment
+	minimumCPUs = 1.0
+	// minimumPIDs is the lowest task limit we consider safe.  The Go runtime creates threads as needed, and each plugin
+	// runs as a separate process with threads of its own.
+	minimumPIDs = 512
+	// memoryUsageWarning is the proportion of the memory limit in use, above which we report a warning
+	memoryUsageWarning = 0.9
+	// cgroupV1Unlimited is the value cgroup v1 reports for memory.limit_in_bytes when no limit is set (the largest
+	// page-aligned int64)
+	cgroupV1Unlimited = 9223372036854771712
+)
+
+// cgroupLimits holds the effective limits and usage for a cgroup.  Limits of -1 mean unlimited.
+type cgroupLimits struct {
+	Version       int
+	Path          string
+	MemoryLimit   int64
+	MemoryHigh    int64
+	MemoryUsage   int64
+	MemoryPeak    int64
+	SwapLimit     int64
+	OOMEvents     int64
+	OOMKills      int64
+	CPUQuota      float64
+	PIDsLimit     int64
+	PIDsCurrent   int64
+	LimitingGroup map[string]string
+}
+
+// readCgroupValue reads a single numeric value from a cgroup file, treating "max" as unlimited (-1)
+func readCgroupValue(path string) (int64, bool) {
+	value, err := readTrimmedFile(path)
+	if err != nil || value == "" {
+		return 0, false
+	}
+	if value == "max" {
+		return -1, true
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if number >= cgroupV1Unlimited {
+		return -1, true
+	}
+	return number, true
+}
+
+// readCgroupKeyedValues reads a flat keyed cgroup file, such as memory.events ("oom 0\noom_kill 0")
+func readCgroupKeyedValues(path string) map[string]int64 {
+	values := make(map[string]int64)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			values[fields[0]], _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return values
+}
+
+// processCgroups parses /proc/<pid>/cgroup, returning the cgroup path for each controller.  The cgroup v2 unified
+// hierarchy is returned under the empty controller name.
+func processCgroups(pid int) (map[string]string, error) {
+	content, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		return nil, err
+	}
+
+	cgroups := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		// Each line is "hierarchy-ID:controller-list:path"
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			cgroups[""] = fields[2]
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			cgroups[controller] = fields[2]
+		}
+	}
+	return cgroups, nil
+}
+
+// tightestLimit applies a limit found at one level of the hierarchy, keeping whichever is lowest and recording the
+// cgroup that imposes it
+func (c *cgroupLimits) tightestLimit(name string, current *int64, value int64, group string) {
+	if value < 0 {
+		return
+	}
+	if *current < 0 || value < *current {
+		*current = value
+		c.LimitingGroup[name] = group
+	}
+}
+
+// ancestors returns a cgroup path and each of its parents, up to the root.  The root is included because inside a
+// container with its own cgroup namespace, the container's cgroup appears as the root, complete with its limits.
+func ancestors(path string) []string {
+	var paths []string
+	current := filepath.Clean("/" + path)
+	for ; current != "/"; current = filepath.Dir(current) {
+		paths = append(paths, current)
+	}
+	return append(paths, current)
+}
+
+// readCgroupV2Limits reads the limits and usage for a cgroup in the unified (v2) hierarchy.  Limits set on a parent
+// (e.g. system.slice) also apply, so the hierarchy is walked to find the effective limits.
+func readCgroupV2Limits(path string) *cgroupLimits {
+	limits := &cgroupLimits{Version: 2, Path: path, MemoryLimit: -1, MemoryHigh: -1, SwapLimit: -1, CPUQuota: -1, PIDsLimit: -1, LimitingGroup: make(map[string]string)}
+	dir := filepath.Join(cgroupRoot, path)
+
+	limits.MemoryUsage, _ = readCgroupValue(dir + "/memory.current")
+	limits.MemoryPeak, _ = readCgroupValue(dir + "/memory.peak")
+	limits.PIDsCurrent, _ = readCgroupValue(dir + "/pids.current")
+	events := readCgroupKeyedValues(dir + "/memory.events")
+	limits.OOMEvents, limits.OOMKills = events["oom"], events["oom_kill"]
+
+	for _, group := range ancestors(path) {
+		groupDir := filepath.Join(cgroupRoot, group)
+		if value, ok := readCgroupValue(groupDir + "/memory.max"); ok {
+			limits.tightestLimit("memory", &limits.MemoryLimit, value, group)
+		}
+		if value, ok := readCgroupValue(groupDir + "/memory.high"); ok {
+			limits.tightestLimit("memory.high", &limits.MemoryHigh, value, group)
+		}
+		if value, ok := readCgroupValue(groupDir + "/memory.swap.max"); ok {
+			limits.tightestLimit("swap", &limits.SwapLimit, value, group)
+		}
+		if value, ok := readCgroupValue(groupDir + "/pids.max"); ok {
+			limits.tightestLimit("pids", &limits.PIDsLimit, value, group)
+		}
+		// cpu.max is "quota period", or "max period" if there's no quota
+		if fields := strings.Fields(readCgroupString(groupDir + "/cpu.max")); len(fields) == 2 && fields[0] != "max" {
+			quota, _ := strconv.ParseFloat(fields[0], 64)
+			period, _ := strconv.ParseFloat(fields[1], 64)
+			if period > 0 && (limits.CPUQuota < 0 || quota/period < limits.CPUQuota) {
+				limits.CPUQuota = quota / period
+				limits.LimitingGroup["cpu"] = group
+			}
+		}
+	}
+	return limits
+}
+
+// readCgroupV1Limits reads the limits and usage for a process's cgroups in the legacy (v1) hierarchies, where each
+// controller has its own hierarchy
+func readCgroupV1Limits(cgroups map[string]string) *cgroupLimits {
+	limits := &cgroupLimits{Version: 1, Path: cgroups["memory"], MemoryLimit: -1, MemoryHigh: -1, SwapLimit: -1, CPUQuota: -1, PIDsLimit: -1, LimitingGroup: make(map[string]string)}
+
+	if path, ok := cgroups["memory"]; ok {
+		dir := filepath.Join(cgroupRoot, "memory", path)
+		limits.MemoryUsage, _ = readCgroupValue(dir + "/memory.usage_in_bytes")
+		limits.MemoryPeak, _ = readCgroupValue(dir + "/memory.max_usage_in_bytes")
+		limits.OOMEvents, _ = readCgroupValue(dir + "/memory.failcnt")
+		limits.OOMKills = readCgroupKeyedValues(dir + "/memory.oom_control")["oom_kill"]
+		for _, group := range ancestors(path) {
+			if value, ok := readCgroupValue(filepath.Join(cgroupRoot, "memory", group, "memory.limit_in_bytes")); ok {
+				limits.tightestLimit("memory", &limits.MemoryLimit, value, group)
+			}
+		}
+	}
+
+	if path, ok := cgroups["cpu"]; ok {
+		for _, group := range ancestors(path) {
+			quota, quotaOK := readCgroupValue(filepath.Join(cgroupRoot, "cpu", group, "cpu.cfs_quota_us"))
+			period, periodOK := readCgroupValue(filepath.Join(cgroupRoot, "cpu", group, "cpu.cfs_period_us"))
+			if quotaOK && periodOK && quota > 0 && period > 0 && (limits.CPUQuota < 0 || float64(quota)/float64(period) < limits.CPUQuota) {
+				limits.CPUQuota = float64(quota) / float64(period)
+				limits.LimitingGroup["cpu"] = group
+			}
+		}
+	}
+
+	if path, ok := cgroups["pids"]; ok {
+		limits.PIDsCurrent, _ = readCgroupValue(filepath.Join(cgroupRoot, "pids", path, "pids.current"))
+		for _, group := range ancestors(path) {
+			if value, ok := readCgroupValue(filepath.Join(cgroupRoot, "pids", group, "pids.max")); ok {
+				limits.tightestLimit("pids", &limits.PIDsLimit, value, group)
+			}
+		}
+	}
+	return limits
+}
+
+// readCgroupString reads a cgroup file as a string, returning an empty string if it can't be read
+func readCgroupString(path string) string {
+	value, _ := readTrimmedFile(path)
+	return value
+}
+
+// formatLimit formats a byte limit, where -1 means unlimited
+func formatLimit(value int64) string {
+	if value < 0 {
+		return "unlimited"
+	}
+	return formatBytes(value)
+}
+
+// writeCgroupLimits writes the limits and usage, and reports anything below Mattermost's minimums in the summary
+func writeCgroupLimits(w io.Writer, limits *cgroupLimits) {
+	source := func(name string) string {
+		if group, ok := limits.LimitingGroup[name]; ok && group != limits.Path {
+			return " (set on " + group + ")"
+		}
+		return ""
+	}
+
+	fmt.Fprintf(w, "cgroup Version: v%d\n", limits.Version)
+	fmt.Fprintf(w, "cgroup:         %s\n\n", limits.Path)
+
+	fmt.Fprintf(w, "Memory Limit:   %s%s\n", formatLimit(limits.MemoryLimit), source("memory"))
+	if limits.Version == 2 {
+		fmt.Fprintf(w, "Memory High:    %s%s\n", formatLimit(limits.MemoryHigh), source("memory.high"))
+		fmt.Fprintf(w, "Swap Limit:     %s%s\n", formatLimit(limits.SwapLimit), source("swap"))
+	}
+	fmt.Fprintf(w, "Memory Usage:   %s\n", formatBytes(limits.MemoryUsage))
+	if limits.MemoryPeak > 0 {
+		fmt.Fprintf(w, "Memory Peak:    %s\n", formatBytes(limits.MemoryPeak))
+	}
+	if limits.Version == 2 {
+		fmt.Fprintf(w, "OOM Events:     %d\n", limits.OOMEvents)
+	} else {
+		fmt.Fprintf(w, "Limit Hits:     %d (memory.failcnt)\n", limits.OOMEvents)
+	}
+	fmt.Fprintf(w, "OOM Kills:      %d\n", limits.OOMKills)
+	if limits.CPUQuota < 0 {
+		fmt.Fprintf(w, "CPU Quota:      unlimited\n")
+	} else {
+		fmt.Fprintf(w, "CPU Quota:      %.2f CPUs%s\n", limits.CPUQuota, source("cpu"))
+	}
+	if limits.PIDsLimit < 0 {
+		fmt.Fprintf(w, "PIDs Limit:     unlimited\n")
+	} else {
+		fmt.Fprintf(w, "PIDs Limit:     %d%s\n", limits.PIDsLimit, source("pids"))
+	}
+	fmt.Fprintf(w, "PIDs Current:   %d\n", limits.PIDsCurrent)
+
+	if limits.MemoryLimit >= 0 {
+		AddSummaryFinding(infoLevel, cgroupArea, "Mattermost is limited to "+formatBytes(limits.MemoryLimit)+" of memory by its cgroup - /proc/meminfo doesn't reflect this")
+		if limits.MemoryLimit < minimumMemoryBytes {
+			AddSummaryFinding(warningLevel, cgroupArea, fmt.Sprintf("The cgroup memory limit of %s is below the documented minimum of %s", formatBytes(limits.MemoryLimit), formatBytes(minimumMemoryBytes)))
+		}
+		if limits.MemoryLimit > 0 && float64(limits.MemoryUsage)/float64(limits.MemoryLimit) >= memoryUsageWarning {
+			AddSummaryFinding(warningLevel, cgroupArea, fmt.Sprintf("Mattermost's cgroup is using %s of its %s memory limit", formatBytes(limits.MemoryUsage), formatBytes(limits.MemoryLimit)))
+		}
+	}
+	if limits.OOMKills > 0 {
+		AddSummaryFinding(errorLevel, cgroupArea, fmt.Sprintf("The OOM killer has killed %d processes in Mattermost's cgroup", limits.OOMKills))
+	}
+	if limits.CPUQuota >= 0 && limits.CPUQuota < minimumCPUs {
+		AddSummaryFinding(warningLevel, cgroupArea, fmt.Sprintf("The cgroup CPU quota of %.2f CPUs is below the documented minimum of %.0f", limits.CPUQuota, minimumCPUs))
+	}
+	if limits.PIDsLimit >= 0 && limits.PIDsLimit < minimumPIDs {
+		AddSummaryFinding(warningLevel, cgroupArea, fmt.Sprintf("The cgroup limits Mattermost to %d tasks, which may stop it creating threads or starting plugins", limits.PIDsLimit))
+	}
+}
+
+// writeSystemdResourceLimits records the resource limits configured on a systemd unit, for when Mattermost isn't
+// running and so has no cgroup to examine
+func writeSystemdResourceLimits(w io.Writer, serviceName string) {
+	properties, err := getSystemdProperties(serviceName, "ControlGroup", "MemoryMax", "MemoryHigh", "MemoryLimit", "CPUQuotaPerSecUSec", "TasksMax")
+	if err != nil {
+		fmt.Fprintf(w, "Unable to read the resource limits of %s: %s\n", serviceName, err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "Mattermost isn't running, so these are the limits configured on %s:\n", serviceName)
+	for _, name := range []string{"MemoryMax", "MemoryHigh", "MemoryLimit", "CPUQuotaPerSecUSec", "TasksMax"} {
+		fmt.Fprintf(w, "  %-20s %s\n", name, properties[name])
+	}
+
+	// systemd reports unlimited values as "infinity" (or the largest uint64)
+	if memoryMax, err := strconv.ParseUint(properties["MemoryMax"], 10, 64); err == nil && memoryMax < math.MaxInt64 && memoryMax < minimumMemoryBytes {
+		AddSummaryFinding(warningLevel, cgroupArea, fmt.Sprintf("%s has MemoryMax=%s, below the documented minimum of %s", serviceName, formatBytes(int64(memoryMax)), formatBytes(minimumMemoryBytes)))
+	}
+}
+
+// CollectCgroupLimits reports the resource limits imposed on Mattermost by its cgroup.  When Mattermost runs in a
+// cgroup with a memory limit (e.g. a systemd unit with MemoryMax, or a container), /proc/meminfo shows the host's
+// memory rather than what Mattermost can actually use.  Both cgroup v1 and v2 are supported, and limits set on parent
+// cgroups (e.g. system.slice) are taken into account.  We report the memory limit and usage, OOM events, the CPU quota
+// and the task (PIDs) limit, and flag any limits below Mattermost's documented minimums.  If Mattermost isn't running,
+// the limits configured on its systemd unit are reported instead.
+// The service manager, the service name, the Mattermost directory and the temp directory are passed as parameters, and
+// the function returns an error object (nil on success).
+// The result is written to cgroup.txt in the temp directory.
+func CollectCgroupLimits(serviceManager string, serviceName string, mmDir string, targetDir string) error {
+	DebugPrint("Collecting cgroup limits - writing to: " + targetDir)
+
+	file, err := os.Create(targetDir + "/cgroup.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for cgroup information in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "cgroup Resource Limits\n======================\n")
+
+	pids := findMattermostProcesses(mmDir)
+	if len(pids) == 0 {
+		if serviceManager == serviceManagerSystemd {
+			writeSystemdResourceLimits(file, serviceName)
+		} else {
+			fmt.Fprintf(file, "Mattermost isn't running, so there's no cgroup to examine\n")
+		}
+		return nil
+	}
+
+	cgroups, err := processCgroups(pids[0])
+	if err != nil {
+		fmt.Fprintf(file, "Unable to read the cgroups of process %d: %s\n", pids[0], err.Error())
+		return errors.New(err.Error())
+	}
+	fmt.Fprintf(file, "Process:        %d\n", pids[0])
+
+	// On a pure v2 system there's only the unified hierarchy.  Hybrid systems mount the v1 controllers alongside it,
+	// in which case the limits are in the v1 hierarchies.
+	var limits *cgroupLimits
+	if _, err := os.Stat(cgroupRoot + "/cgroup.controllers"); err == nil {
+		limits = readCgroupV2Limits(cgroups[""])
+	} else {
+		limits = readCgroupV1Limits(cgroups)
+	}
+	writeCgroupLimits(file, limits)
+
+	return nil
+}
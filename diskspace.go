@@ -0,0 +1,404 @@
+// Package main contains the disk space collector, which reports space and inode usage for every mounted filesystem
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// diskArea is the area name used for summary findings relating to disk space
+const diskArea = "Disk Space"
+
+const (
+	// statfsTimeout is how long we wait for each filesystem to respond.  statfs on a dead NFS mount can block
+	// indefinitely, which is why this collector replaced `df`.
+	statfsTimeout = 5 * time.Second
+	// diskUsageWarning and diskUsageError are the percentages of space or inodes in use at which we report findings
+	diskUsageWarning = 90
+	diskUsageError   = 95
+)
+
+// defaultDatabaseDirectories are checked for database data when no local database process is found
+var defaultDatabaseDirectories = []string{"/var/lib/postgresql", "/var/lib/pgsql", "/var/lib/mysql"}
+
+// unreportedFilesystems are always full, so they're not reported as near-full in the summary
+var unreportedFilesystems = map[string]bool{"squashfs": true, "iso9660": true}
+
+// mountPoint is a single entry from /proc/self/mountinfo, plus its usage from statfs
+type mountPoint struct {
+	Device     string
+	MountPoint string
+	Options    string
+	FSType     string
+	Source     string
+	Stat       *syscall.Statfs_t
+	TimedOut   bool
+	Err        error
+}
+
+// mountPath is one of the Mattermost paths we locate on the mounted filesystems
+type mountPath struct {
+	Label string
+	Path  string
+	// Resolved is the path with symlinks resolved.  If resolution fails or times out, it's the path as configured.
+	Resolved string
+	TimedOut bool
+	Err      error
+}
+
+// unescapeMountField decodes the octal escapes (e.g. "\040" for a space) used in /proc/self/mountinfo
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var result strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(field[i])
+	}
+	return result.String()
+}
+
+// readMounts parses /proc/self/mountinfo.  Each line is
+// "ID parent-ID major:minor root mount-point options [optional fields...] - fstype source super-options".
+func readMounts() ([]*mountPoint, error) {
+	content, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []*mountPoint
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		before, after, found := strings.Cut(line, " - ")
+		fields := strings.Fields(before)
+		tail := strings.Fields(after)
+		if !found || len(fields) < 6 || len(tail) < 2 {
+			continue
+		}
+		mounts = append(mounts, &mountPoint{
+			Device:     fields[2],
+			MountPoint: unescapeMountField(fields[4]),
+			Options:    fields[5],
+			FSType:     tail[0],
+			Source:     unescapeMountField(tail[1]),
+		})
+	}
+	return mounts, nil
+}
+
+// statMounts calls statfs on each mount concurrently, giving up on any that haven't responded within statfsTimeout.
+// A statfs that hangs (e.g. on an unreachable NFS server) can't be cancelled, so its goroutine is abandoned.
+func statMounts(mounts []*mountPoint) {
+	type statResult struct {
+		stat *syscall.Statfs_t
+		err  error
+	}
+
+	results := make([]chan statResult, len(mounts))
+	for i, mount := range mounts {
+		results[i] = make(chan statResult, 1)
+		go func(path string, result chan<- statResult) {
+			var stat syscall.Statfs_t
+			err := syscall.Statfs(path, &stat)
+			result <- statResult{&stat, err}
+		}(mount.MountPoint, results[i])
+	}
+
+	deadline := time.Now().Add(statfsTimeout)
+	for i, mount := range mounts {
+		var result statResult
+		select {
+		case result = <-results[i]:
+		case <-time.After(time.Until(deadline)):
+			// Check once more, in case the result arrived at the same time as the deadline
+			select {
+			case result = <-results[i]:
+			default:
+				mount.TimedOut = true
+				continue
+			}
+		}
+		if result.err != nil {
+			mount.Err = result.err
+		} else {
+			mount.Stat = result.stat
+		}
+	}
+}
+
+// resolveMountPaths resolves the symlinks in each path concurrently, so that it can be matched to the mount holding it.
+// Resolving a path stats every component, which blocks on a dead NFS mount just like statfs, so we give up on any that
+// haven't resolved within statfsTimeout and match on the path as configured.
+func resolveMountPaths(paths []mountPath) {
+	type resolveResult struct {
+		resolved string
+		err      error
+	}
+
+	results := make([]chan resolveResult, len(paths))
+	for i := range paths {
+		paths[i].Resolved = paths[i].Path
+		results[i] = make(chan resolveResult, 1)
+		go func(path string, result chan<- resolveResult) {
+			resolved, err := filepath.EvalSymlinks(path)
+			result <- resolveResult{resolved, err}
+		}(paths[i].Path, results[i])
+	}
+
+	deadline := time.Now().Add(statfsTimeout)
+	for i := range paths {
+		var result resolveResult
+		select {
+		case result = <-results[i]:
+		case <-time.After(time.Until(deadline)):
+			select {
+			case result = <-results[i]:
+			default:
+				paths[i].TimedOut = true
+				continue
+			}
+		}
+		if result.err != nil {
+			paths[i].Err = result.err
+		} else {
+			paths[i].Resolved = result.resolved
+		}
+	}
+}
+
+// diskUsage returns the used and available bytes and the percentage in use, calculated the same way as df: the
+// percentage is of the space available to unprivileged users, so excludes the reserved blocks
+func diskUsage(stat *syscall.Statfs_t) (used int64, available int64, percent int) {
+	blockSize := int64(stat.Bsize)
+	used = int64(stat.Blocks-stat.Bfree) * blockSize
+	available = int64(stat.Bavail) * blockSize
+	if used+available > 0 {
+		percent = int((used*100 + used + available - 1) / (used + available))
+	}
+	return used, available, percent
+}
+
+// inodeUsage returns the used inodes and the percentage in use.  Some filesystems (e.g. btrfs) don't have a fixed
+// number of inodes, and report zero.
+func inodeUsage(stat *syscall.Statfs_t) (used uint64, percent int) {
+	if stat.Files == 0 {
+		return 0, 0
+	}
+	used = stat.Files - stat.Ffree
+	return used, int((used*100 + stat.Files - 1) / stat.Files)
+}
+
+// mountForPath returns the mount holding a path: the mount point that is the longest prefix of the path.  Where a
+// mount point is mounted over, the last (visible) mount wins.  Symlinks must already have been resolved (see
+// resolveMountPaths).
+func mountForPath(mounts []*mountPoint, path string) *mountPoint {
+	var best *mountPoint
+	for _, mount := range mounts {
+		prefix := strings.TrimSuffix(mount.MountPoint, "/") + "/"
+		if path != mount.MountPoint && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if best == nil || len(mount.MountPoint) >= len(best.MountPoint) {
+			best = mount
+		}
+	}
+	return best
+}
+
+// findDatabaseDirectories returns the data directories of any PostgreSQL or MySQL servers running on this host.  Both
+// servers change to their data directory on startup, so we use the working directory of their processes.  If neither
+// is running, we fall back to the default data directories.  These aren't checked here, as the data directory may be on
+// a hung mount; those that don't exist are dropped when they're resolved.
+func findDatabaseDirectories() []string {
+	seen := make(map[string]bool)
+	var directories []string
+	for _, pid := range listProcessIDs() {
+		stat, err := readProcStat(pid)
+		if err != nil || (stat.Comm != "postgres" && stat.Comm != "postmaster" && stat.Comm != "mysqld" && stat.Comm != "mariadbd") {
+			continue
+		}
+		cwd, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/cwd")
+		if err != nil || cwd == "/" || seen[cwd] {
+			continue
+		}
+		seen[cwd] = true
+		directories = append(directories, cwd)
+	}
+
+	if len(directories) == 0 {
+		directories = append(directories, defaultDatabaseDirectories...)
+	}
+	return directories
+}
+
+// isReadOnly reports whether a mount's options include "ro"
+func isReadOnly(mount *mountPoint) bool {
+	for _, option := range strings.Split(mount.Options, ",") {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMountTable writes the space and inode usage of every mount, in the style of `df -a`
+func writeMountTable(w io.Writer, mounts []*mountPoint) {
+	fmt.Fprintf(w, "%-40s %-12s %10s %10s %10s %5s %12s %12s %5s  %s\n", "Filesystem", "Type", "Size", "Used", "Avail", "Use%", "Inodes", "IUsed", "IUse%", "Mounted on")
+	for _, mount := range mounts {
+		switch {
+		case mount.TimedOut:
+			fmt.Fprintf(w, "%-40s %-12s %s  %s\n", mount.Source, mount.FSType, "(no response within "+statfsTimeout.String()+")", mount.MountPoint)
+		case mount.Err != nil:
+			fmt.Fprintf(w, "%-40s %-12s %s  %s\n", mount.Source, mount.FSType, "("+mount.Err.Error()+")", mount.MountPoint)
+		default:
+			used, available, percent := diskUsage(mount.Stat)
+			inodesUsed, inodePercent := inodeUsage(mount.Stat)
+			fmt.Fprintf(w, "%-40s %-12s %10s %10s %10s %4d%% %12d %12d %4d%%  %s\n", mount.Source, mount.FSType,
+				formatBytes(int64(mount.Stat.Blocks)*int64(mount.Stat.Bsize)), formatBytes(used), formatBytes(available), percent,
+				mount.Stat.Files, inodesUsed, inodePercent, mount.MountPoint)
+		}
+	}
+}
+
+// reportFullMounts adds summary findings for filesystems that are nearly out of space or inodes.  Bind mounts of the
+// same filesystem are reported once, naming any Mattermost paths that it holds.
+func reportFullMounts(mounts []*mountPoint, holders map[*mountPoint][]string) {
+	reported := make(map[string]bool)
+	for _, mount := range mounts {
+		if mount.Stat == nil || mount.Stat.Blocks == 0 || unreportedFilesystems[mount.FSType] || reported[mount.Device] {
+			continue
+		}
+
+		// Use the labels from every mount of this device, as a path may be held by a bind mount
+		var labels []string
+		for holder, holderLabels := range holders {
+			if holder.Device == mount.Device {
+				labels = append(labels, holderLabels...)
+			}
+		}
+		sort.Strings(labels)
+		description := mount.MountPoint
+		if len(labels) > 0 {
+			description += " (holding the " + strings.Join(labels, ", ") + " directories)"
+		}
+
+		_, _, percent := diskUsage(mount.Stat)
+		_, inodePercent := inodeUsage(mount.Stat)
+		for _, usage := range []struct {
+			what    string
+			percent int
+		}{{"space", percent}, {"inodes", inodePercent}} {
+			switch {
+			case usage.percent >= diskUsageError:
+				AddSummaryFinding(errorLevel, diskArea, fmt.Sprintf("%s is %d%% full (%s)", description, usage.percent, usage.what))
+				reported[mount.Device] = true
+			case usage.percent >= diskUsageWarning:
+				AddSummaryFinding(warningLevel, diskArea, fmt.Sprintf("%s is %d%% full (%s)", description, usage.percent, usage.what))
+				reported[mount.Device] = true
+			}
+		}
+	}
+}
+
+// GetDiskSpace reports the space and inode usage of every mounted filesystem.  Mounts are read from
+// /proc/self/mountinfo and queried with statfs, with a timeout for each, so a dead NFS mount is reported rather than
+// hanging the collection (as `df` would).  We also identify which mounts hold the Mattermost install, log and local file
+// storage directories and the data directory of any local database, and report filesystems that are nearly out of
+// space or inodes, and Mattermost directories on read-only mounts.
+// The parsed config, the Mattermost directory and the temp directory are passed as parameters, and the function
+// returns an error object (nil on success).
+// The output is written to diskspace.txt
+func GetDiskSpace(config *mmConfig, mmDir string, targetDir string) error {
+	DebugPrint("Getting disk space")
+
+	file, err := os.Create(targetDir + "/diskspace.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for disk space in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	mounts, err := readMounts()
+	if err != nil {
+		LogMessage(warningLevel, "Unable to read the list of mounted filesystems")
+		return errors.New(err.Error())
+	}
+	statMounts(mounts)
+
+	fmt.Fprintf(file, "Disk Space\n==========\n")
+	writeMountTable(file, mounts)
+
+	var unresponsive []string
+	for _, mount := range mounts {
+		if mount.TimedOut {
+			unresponsive = append(unresponsive, mount.MountPoint)
+		}
+	}
+	if len(unresponsive) > 0 {
+		AddSummaryFinding(errorLevel, diskArea, "These filesystems didn't respond within "+statfsTimeout.String()+" and may be hung: "+strings.Join(unresponsive, ", "))
+	}
+
+	paths := []mountPath{
+		{Label: "install", Path: filepath.Clean(mmDir)},
+		{Label: "log", Path: filepath.Clean(config.LogDirectory)},
+	}
+	if config.FileDriverName == "" || config.FileDriverName == "local" {
+		paths = append(paths, mountPath{Label: "data", Path: resolveInstallPath(config.FileDirectory, defaultFileDirectory, mmDir)})
+	}
+	for _, directory := range findDatabaseDirectories() {
+		paths = append(paths, mountPath{Label: "database", Path: directory})
+	}
+	resolveMountPaths(paths)
+
+	fmt.Fprintf(file, "\nMattermost Paths\n================\n")
+	fmt.Fprintf(file, "%-10s %-50s %-30s %5s %5s\n", "Path", "Directory", "Mounted on", "Use%", "IUse%")
+	holders := make(map[*mountPoint][]string)
+	for _, path := range paths {
+		if path.Label == "database" && os.IsNotExist(path.Err) {
+			continue
+		}
+		note := ""
+		if path.TimedOut {
+			note = "  (didn't resolve within " + statfsTimeout.String() + " - matched as configured)"
+			AddSummaryFinding(errorLevel, diskArea, "The "+path.Label+" directory ("+path.Path+") didn't respond within "+statfsTimeout.String()+" and may be on a hung mount")
+		}
+
+		mount := mountForPath(mounts, path.Resolved)
+		if mount == nil {
+			fmt.Fprintf(file, "%-10s %-50s %s%s\n", path.Label, path.Path, "(not found)", note)
+			continue
+		}
+		holders[mount] = append(holders[mount], path.Label)
+
+		if mount.Stat == nil {
+			fmt.Fprintf(file, "%-10s %-50s %-30s %5s %5s%s\n", path.Label, path.Path, mount.MountPoint, "-", "-", note)
+		} else {
+			_, _, percent := diskUsage(mount.Stat)
+			_, inodePercent := inodeUsage(mount.Stat)
+			fmt.Fprintf(file, "%-10s %-50s %-30s %4d%% %4d%%%s\n", path.Label, path.Path, mount.MountPoint, percent, inodePercent, note)
+		}
+
+		// Mattermost needs to write to all of these except the install directory
+		if path.Label != "install" && isReadOnly(mount) {
+			AddSummaryFinding(errorLevel, diskArea, "The "+path.Label+" directory ("+path.Path+") is on a read-only mount ("+mount.MountPoint+")")
+		}
+	}
+
+	reportFullMounts(mounts, holders)
+
+	return nil
+}
@@ -0,0 +1,583 @@
+// Package main contains the collector for Mattermost deployments running under Docker or Docker Compose
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dockerArea is the area name used for summary findings relating to Docker
+const dockerArea = "Docker"
+
+const (
+	// defaultDockerSocket is the usual location of the Docker Engine API socket
+	defaultDockerSocket = "/var/run/docker.sock"
+	// dockerAPITimeout limits how long a single Docker Engine API request can take, including copying files
+	dockerAPITimeout = 2 * time.Minute
+	// dockerLogTailLines is the number of lines of container output we collect
+	dockerLogTailLines = "10000"
+	// defaultContainerMattermostDir is the install directory used by the official Mattermost images
+	defaultContainerMattermostDir = "/mattermost"
+)
+
+// dockerContainerSummary is an entry in the Docker Engine API's container list
+type dockerContainerSummary struct {
+	ID     string `json:"Id"`
+	Names  []string
+	Image  string
+	State  string
+	Status string
+	Labels map[string]string
+}
+
+// dockerContainerInspect holds the parts of the Docker Engine API's container inspect output that we report on.  The
+// full output is written to the support packet as-is.
+type dockerContainerInspect struct {
+	Name         string
+	RestartCount int
+	State        struct {
+		Status     string
+		Running    bool
+		OOMKilled  bool
+		ExitCode   int
+		Error      string
+		StartedAt  string
+		FinishedAt string
+		Health     *struct {
+			Status        string
+			FailingStreak int
+			Log           []struct {
+				Start    string
+				ExitCode int
+				Output   string
+			}
+		}
+	}
+	Config struct {
+		Image      string
+		Tty        bool
+		WorkingDir string
+		Env        []string
+	}
+	HostConfig struct {
+		Memory            int64
+		MemoryReservation int64
+		NanoCpus          int64
+		CpuQuota          int64
+		CpuPeriod         int64
+		PidsLimit         *int64
+		Ulimits           []struct {
+			Name string
+			Soft int64
+			Hard int64
+		}
+		RestartPolicy struct {
+			Name              string
+			MaximumRetryCount int
+		}
+	}
+	Mounts []struct {
+		Type        string
+		Name        string
+		Source      string
+		Destination string
+		RW          bool
+	}
+}
+
+// dockerClient is a minimal client for the Docker Engine API, which is served over HTTP on a unix socket.  Talking to
+// the API directly means we don't depend on the docker CLI being installed.
+type dockerClient struct {
+	httpClient *http.Client
+}
+
+// newDockerClient creates a client that connects to the Docker Engine API on the given unix socket
+func newDockerClient(socketPath string) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &dockerClient{httpClient: &http.Client{Transport: transport, Timeout: dockerAPITimeout}}
+}
+
+// get makes a request to the Docker Engine API, returning the response body if the request succeeded.  The caller is
+// responsible for closing the body.
+func (c *dockerClient) get(apiPath string) (io.ReadCloser, error) {
+	DebugPrint("Docker API request: " + apiPath)
+
+	response, err := c.httpClient.Get("http://docker" + apiPath)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("%s returned %s: %s", apiPath, response.Status, strings.TrimSpace(string(message)))
+	}
+	return response.Body, nil
+}
+
+// getJSON makes a request to the Docker Engine API and decodes the JSON response into result.  The raw response is
+// also returned, so that it can be included in the support packet.
+func (c *dockerClient) getJSON(apiPath string, result interface{}) ([]byte, error) {
+	body, err := c.get(apiPath)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, result); err != nil {
+		return nil, fmt.Errorf("unable to parse response from %s: %w", apiPath, err)
+	}
+	return content, nil
+}
+
+// dockerSocketFromEnvironment returns the socket path from DOCKER_HOST, if it's a unix socket, otherwise the default
+func dockerSocketFromEnvironment() string {
+	if dockerHost := os.Getenv("DOCKER_HOST"); strings.HasPrefix(dockerHost, "unix://") {
+		return strings.TrimPrefix(dockerHost, "unix://")
+	}
+	return defaultDockerSocket
+}
+
+// isMattermostImage returns true if the image looks like a Mattermost server image, e.g.
+// "mattermost/mattermost-enterprise-edition:9.11" or a custom build such as "registry.example.com/mattermost:latest".
+// Related images, such as the push proxy, are excluded.
+func isMattermostImage(image string) bool {
+	name := strings.ToLower(path.Base(image))
+	if index := strings.IndexAny(name, ":@"); index != -1 {
+		name = name[:index]
+	}
+	return strings.Contains(name, "mattermost") && !strings.Contains(name, "push-proxy")
+}
+
+// containerName returns the name of a container without Docker's leading slash
+func containerName(names []string, id string) string {
+	if len(names) > 0 {
+		return strings.TrimPrefix(names[0], "/")
+	}
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// writeContainerList writes a table of every container on the host, so that the state of related containers
+// (database, proxy, etc.) can be seen alongside Mattermost's.
+func writeContainerList(outputFile string, containers []dockerContainerSummary) error {
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := tabwriter.NewWriter(file, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tIMAGE\tSTATE\tSTATUS\tCOMPOSE PROJECT\tCOMPOSE SERVICE\n")
+	for _, container := range containers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			containerName(container.Names, container.ID),
+			container.Image,
+			container.State,
+			container.Status,
+			container.Labels["com.docker.compose.project"],
+			container.Labels["com.docker.compose.service"])
+	}
+	return w.Flush()
+}
+
+// demultiplexDockerLogs copies container output from the Docker Engine API to the writer.  For containers without a
+// TTY, stdout and stderr are multiplexed into a single stream in which each frame is preceded by an 8 byte header:
+// the stream type, three bytes of padding and the frame size as a big-endian uint32.
+func demultiplexDockerLogs(reader io.Reader, writer io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if _, err := io.CopyN(writer, reader, int64(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// collectContainerLogs writes the most recent output of the container (i.e. what `docker logs` would show)
+func collectContainerLogs(client *dockerClient, id string, tty bool, outputFile string) error {
+	query := url.Values{}
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	query.Set("timestamps", "1")
+	query.Set("tail", dockerLogTailLines)
+
+	body, err := client.get("/containers/" + id + "/logs?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if tty {
+		_, err = io.Copy(file, body)
+		return err
+	}
+	return demultiplexDockerLogs(body, file)
+}
+
+// copyFromContainer copies a file or directory out of the container filesystem into the target directory, using the
+// Docker Engine API's archive endpoint (the equivalent of `docker cp`).  The archive's entries are named relative to
+// the parent of the requested path, so /mattermost/logs ends up in <targetDir>/logs.
+func copyFromContainer(client *dockerClient, id string, containerPath string, targetDir string) error {
+	body, err := client.get("/containers/" + id + "/archive?path=" + url.QueryEscape(containerPath))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	archive := tar.NewReader(body)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Guard against entries that would be written outside the target directory
+		name := filepath.Clean(header.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			LogMessage(warningLevel, "Skipping unexpected path in container archive: "+header.Name)
+			continue
+		}
+		destination := filepath.Join(targetDir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(destination, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+				return err
+			}
+			file, err := os.Create(destination)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, archive)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			DebugPrint("Skipping non-regular file in container archive: " + header.Name)
+		}
+	}
+}
+
+// containerEnvironment converts a container's environment (a list of NAME=value strings) into a map
+func containerEnvironment(env []string) map[string]string {
+	environment := make(map[string]string)
+	for _, variable := range env {
+		if name, value, found := strings.Cut(variable, "="); found {
+			environment[name] = value
+		}
+	}
+	return environment
+}
+
+// writeContainerStatus writes a human-readable report of the container's state, health, restarts, resource limits
+// and mounts, and adds summary findings for anything that looks wrong.
+func writeContainerStatus(w io.Writer, name string, inspect *dockerContainerInspect) {
+	fmt.Fprintf(w, "Container:      %s\n", name)
+	fmt.Fprintf(w, "Image:          %s\n", inspect.Config.Image)
+	fmt.Fprintf(w, "State:          %s\n", inspect.State.Status)
+	fmt.Fprintf(w, "Started:        %s\n", inspect.State.StartedAt)
+	if !inspect.State.Running {
+		fmt.Fprintf(w, "Finished:       %s\n", inspect.State.FinishedAt)
+	}
+	fmt.Fprintf(w, "Exit Code:      %d\n", inspect.State.ExitCode)
+	if inspect.State.Error != "" {
+		fmt.Fprintf(w, "Error:          %s\n", inspect.State.Error)
+	}
+	fmt.Fprintf(w, "OOM Killed:     %t\n", inspect.State.OOMKilled)
+	fmt.Fprintf(w, "Restart Count:  %d\n", inspect.RestartCount)
+	fmt.Fprintf(w, "Restart Policy: %s", inspect.HostConfig.RestartPolicy.Name)
+	if inspect.HostConfig.RestartPolicy.MaximumRetryCount > 0 {
+		fmt.Fprintf(w, " (max %d retries)", inspect.HostConfig.RestartPolicy.MaximumRetryCount)
+	}
+	fmt.Fprintf(w, "\n")
+
+	if !inspect.State.Running {
+		AddSummaryFinding(errorLevel, dockerArea, fmt.Sprintf("Container %s is %s (exit code %d)", name, inspect.State.Status, inspect.State.ExitCode))
+	}
+	if inspect.State.OOMKilled {
+		AddSummaryFinding(errorLevel, dockerArea, "Container "+name+" was killed by the OOM killer - check its memory limit")
+	}
+	if inspect.RestartCount > 0 {
+		AddSummaryFinding(warningLevel, dockerArea, fmt.Sprintf("Container %s has been restarted %d times", name, inspect.RestartCount))
+	}
+
+	fmt.Fprintf(w, "\nHealth Check\n")
+	if inspect.State.Health == nil {
+		fmt.Fprintf(w, "  No health check configured\n")
+	} else {
+		fmt.Fprintf(w, "  Status:         %s\n", inspect.State.Health.Status)
+		fmt.Fprintf(w, "  Failing Streak: %d\n", inspect.State.Health.FailingStreak)
+		for _, check := range inspect.State.Health.Log {
+			fmt.Fprintf(w, "  %s exit=%d %s\n", check.Start, check.ExitCode, strings.TrimSpace(check.Output))
+		}
+		if inspect.State.Health.Status == "unhealthy" {
+			AddSummaryFinding(errorLevel, dockerArea, fmt.Sprintf("Container %s is unhealthy (%d consecutive failed health checks)", name, inspect.State.Health.FailingStreak))
+		}
+	}
+
+	fmt.Fprintf(w, "\nResource Limits\n")
+	if inspect.HostConfig.Memory > 0 {
+		fmt.Fprintf(w, "  Memory:             %s\n", formatBytes(inspect.HostConfig.Memory))
+	} else {
+		fmt.Fprintf(w, "  Memory:             unlimited\n")
+	}
+	if inspect.HostConfig.MemoryReservation > 0 {
+		fmt.Fprintf(w, "  Memory Reservation: %s\n", formatBytes(inspect.HostConfig.MemoryReservation))
+	}
+	switch {
+	case inspect.HostConfig.NanoCpus > 0:
+		fmt.Fprintf(w, "  CPUs:               %.2f\n", float64(inspect.HostConfig.NanoCpus)/1e9)
+	case inspect.HostConfig.CpuQuota > 0 && inspect.HostConfig.CpuPeriod > 0:
+		fmt.Fprintf(w, "  CPUs:               %.2f\n", float64(inspect.HostConfig.CpuQuota)/float64(inspect.HostConfig.CpuPeriod))
+	default:
+		fmt.Fprintf(w, "  CPUs:               unlimited\n")
+	}
+	if inspect.HostConfig.PidsLimit != nil && *inspect.HostConfig.PidsLimit > 0 {
+		fmt.Fprintf(w, "  PIDs:               %d\n", *inspect.HostConfig.PidsLimit)
+	}
+	for _, ulimit := range inspect.HostConfig.Ulimits {
+		fmt.Fprintf(w, "  ulimit %-12s soft=%d hard=%d\n", ulimit.Name+":", ulimit.Soft, ulimit.Hard)
+	}
+
+	fmt.Fprintf(w, "\nMounts\n")
+	if len(inspect.Mounts) == 0 {
+		fmt.Fprintf(w, "  None - data written by Mattermost will be lost when the container is removed\n")
+		AddSummaryFinding(warningLevel, dockerArea, "Container "+name+" has no volumes or bind mounts, so its config, data and logs are not persistent")
+	}
+	for _, mount := range inspect.Mounts {
+		source := mount.Source
+		if mount.Type == "volume" {
+			source = mount.Name
+		}
+		access := "ro"
+		if mount.RW {
+			access = "rw"
+		}
+		fmt.Fprintf(w, "  %-7s %s -> %s (%s)\n", mount.Type, source, mount.Destination, access)
+	}
+}
+
+// captureComposeProject copies the Docker Compose files (and the .env file alongside them) for the container's project,
+// using the labels that Compose adds to every container it creates.
+func captureComposeProject(labels map[string]string, targetDir string) {
+	var files []string
+	if configFiles := labels["com.docker.compose.project.config_files"]; configFiles != "" {
+		files = append(files, strings.Split(configFiles, ",")...)
+	}
+	if workingDir := labels["com.docker.compose.project.working_dir"]; workingDir != "" {
+		if _, err := os.Stat(filepath.Join(workingDir, ".env")); err == nil {
+			files = append(files, filepath.Join(workingDir, ".env"))
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	DebugPrint("Capturing Docker Compose project " + labels["com.docker.compose.project"])
+	captureConfigFiles(files, targetDir)
+}
+
+// collectMattermostContainer collects everything we need from a single Mattermost container.  It returns the path of
+// the config file copied out of the container and the Mattermost directory inside the container, if available.
+func collectMattermostContainer(client *dockerClient, container dockerContainerSummary, dockerDir string) (string, string, bool) {
+	name := containerName(container.Names, container.ID)
+	containerDir := filepath.Join(dockerDir, name)
+	noErrors := true
+
+	LogMessage(infoLevel, "Collecting information from container "+name)
+	if err := os.MkdirAll(containerDir, 0755); err != nil {
+		LogMessage(warningLevel, "Failed to create directory: "+containerDir)
+		return "", "", false
+	}
+
+	var inspect dockerContainerInspect
+	raw, err := client.getJSON("/containers/"+container.ID+"/json", &inspect)
+	if err != nil {
+		LogMessage(warningLevel, "Failed to inspect container "+name+": "+err.Error())
+		return "", "", false
+	}
+	if err := os.WriteFile(filepath.Join(containerDir, "inspect.json"), raw, 0644); err != nil {
+		LogMessage(warningLevel, "Failed to write inspect output for container "+name+": "+err.Error())
+		noErrors = false
+	}
+
+	if file, err := os.Create(filepath.Join(containerDir, "status.txt")); err != nil {
+		LogMessage(warningLevel, "Failed to create status file for container "+name+": "+err.Error())
+		noErrors = false
+	} else {
+		writeContainerStatus(file, name, &inspect)
+		file.Close()
+	}
+
+	if inspect.State.Running {
+		var stats map[string]interface{}
+		if raw, err := client.getJSON("/containers/"+container.ID+"/stats?stream=false", &stats); err != nil {
+			DebugPrint("Failed to get resource usage for container " + name + ": " + err.Error())
+		} else if err := os.WriteFile(filepath.Join(containerDir, "stats.json"), raw, 0644); err != nil {
+			LogMessage(warningLevel, "Failed to write resource usage for container "+name+": "+err.Error())
+		}
+	}
+
+	if err := collectContainerLogs(client, container.ID, inspect.Config.Tty, filepath.Join(containerDir, "container.log")); err != nil {
+		LogMessage(warningLevel, "Failed to collect output of container "+name+": "+err.Error())
+		noErrors = false
+	}
+
+	captureComposeProject(container.Labels, filepath.Join(containerDir, "compose"))
+
+	// Work out where the config and logs are inside the container, honouring the same environment overrides as
+	// Mattermost itself
+	mmDir := inspect.Config.WorkingDir
+	if mmDir == "" || mmDir == "/" {
+		mmDir = defaultContainerMattermostDir
+	}
+	environment := containerEnvironment(inspect.Config.Env)
+
+	configPath := path.Join(mmDir, "config", "config.json")
+	if mmConfigEnv := environment["MM_CONFIG"]; mmConfigEnv != "" {
+		if strings.Contains(mmConfigEnv, "://") {
+			LogMessage(infoLevel, "Container "+name+" stores its config in the database - config.json will not be collected")
+			configPath = ""
+		} else {
+			configPath = mmConfigEnv
+			if !path.IsAbs(configPath) {
+				configPath = path.Join(mmDir, configPath)
+			}
+		}
+	}
+	logDir := path.Join(mmDir, "logs")
+	if logLocation := environment["MM_LOGSETTINGS_FILELOCATION"]; logLocation != "" {
+		logDir = logLocation
+		if !path.IsAbs(logDir) {
+			logDir = path.Join(mmDir, logDir)
+		}
+	}
+
+	copiedConfig := ""
+	if configPath != "" {
+		if err := copyFromContainer(client, container.ID, configPath, containerDir); err != nil {
+			LogMessage(warningLevel, "Failed to copy config file from container "+name+": "+err.Error())
+			noErrors = false
+		} else {
+			copiedConfig = filepath.Join(containerDir, path.Base(configPath))
+		}
+	}
+	if err := copyFromContainer(client, container.ID, logDir, containerDir); err != nil {
+		LogMessage(warningLevel, "Failed to copy logs from container "+name+": "+err.Error())
+		noErrors = false
+	}
+
+	return copiedConfig, mmDir, noErrors
+}
+
+// CollectDockerDeployment collects information about Mattermost running under Docker (or Docker Compose) by talking
+// to the Docker Engine API on the given unix socket.  Every container whose image looks like a Mattermost server image
+// is examined: its inspect output, a report of its state, health, restart count, resource limits and mounts, its
+// recent output, any Compose files, and the config file and logs copied out of the container filesystem.
+// The socket path and the temp directory are passed as parameters.  The function returns the path of the collected
+// config file and the Mattermost directory inside the container (both empty if no config file was collected), and an
+// error object (nil on success).
+// The information is written to the docker directory in the temp directory, with a subdirectory per container.
+func CollectDockerDeployment(socketPath string, targetDir string) (string, string, error) {
+	DebugPrint("Collecting Docker deployment information from " + socketPath)
+
+	dockerDir := targetDir + "/docker"
+	if err := os.MkdirAll(dockerDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+dockerDir)
+		return "", "", errors.New(err.Error())
+	}
+
+	client := newDockerClient(socketPath)
+
+	var version map[string]interface{}
+	raw, err := client.getJSON("/version", &version)
+	if err != nil {
+		LogMessage(errorLevel, "Unable to connect to the Docker Engine API on "+socketPath)
+		AddSummaryFinding(errorLevel, dockerArea, "Unable to connect to the Docker Engine API on "+socketPath+" - use --docker-socket if it's elsewhere")
+		return "", "", errors.New(err.Error())
+	}
+	if err := os.WriteFile(dockerDir+"/version.json", raw, 0644); err != nil {
+		LogMessage(warningLevel, "Failed to write Docker version information: "+err.Error())
+	}
+
+	var containers []dockerContainerSummary
+	if _, err := client.getJSON("/containers/json?all=1", &containers); err != nil {
+		LogMessage(errorLevel, "Unable to list containers")
+		return "", "", errors.New(err.Error())
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containerName(containers[i].Names, containers[i].ID) < containerName(containers[j].Names, containers[j].ID)
+	})
+	if err := writeContainerList(dockerDir+"/containers.txt", containers); err != nil {
+		LogMessage(warningLevel, "Failed to write container list: "+err.Error())
+	}
+
+	configPath, mmDir := "", ""
+	found := false
+	for _, container := range containers {
+		if !isMattermostImage(container.Image) {
+			continue
+		}
+		found = true
+		containerConfig, containerDir, ok := collectMattermostContainer(client, container, dockerDir)
+		if !ok {
+			LogMessage(warningLevel, "Not all information was collected from container "+containerName(container.Names, container.ID))
+		}
+		if configPath == "" && containerConfig != "" {
+			configPath, mmDir = containerConfig, containerDir
+		}
+	}
+
+	if !found {
+		LogMessage(warningLevel, "No Mattermost containers found")
+		AddSummaryFinding(errorLevel, dockerArea, "No Mattermost containers were found - see docker/containers.txt for the containers on this host")
+	}
+
+	return configPath, mmDir, nil
+}
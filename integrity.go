@@ -0,0 +1,254 @@
+// Package main contains the installation integrity check, which looks for broken or partial upgrades
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// integrityArea is the area name used for summary findings relating to the installation integrity check
+const integrityArea = "Installation"
+
+const (
+	// maxListedFiles limits how many files with unexpected owners or modes are listed, as a wrongly-owned install may
+	// have thousands of them
+	maxListedFiles = 50
+	// maxReleaseSpread is how far apart the server binary and the webapp can be modified before we suspect they come
+	// from different releases.  Both are extracted from the same release archive, so are normally within hours.
+	maxReleaseSpread = 7 * 24 * time.Hour
+)
+
+// installDirectories are the directories that come from the release archive, which should all be present
+var installDirectories = []string{"bin", "client", "prepackaged_plugins", "i18n", "fonts", "templates"}
+
+// requiredInstallFiles are files without which Mattermost won't start, or won't serve the webapp
+var requiredInstallFiles = []string{"bin/mattermost", "client/root.html", "i18n/en.json"}
+
+// upgradeBackupPattern matches the names commonly given to copies of the install directory taken before an upgrade,
+// e.g. mattermost-back-2024-01-31, mattermost.bak or mattermost_old
+var upgradeBackupPattern = regexp.MustCompile(`(?i)^mattermost.*(back|bak|old|orig|prev|upgrade)`)
+
+// directoryStats summarises the files in one of the install directories
+type directoryStats struct {
+	Files  int
+	Bytes  int64
+	Oldest time.Time
+	Newest time.Time
+}
+
+// fileOwnership returns the user and group IDs of a file
+func fileOwnership(info fs.FileInfo) (uint32, uint32, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return stat.Uid, stat.Gid, true
+}
+
+// sha256File computes the SHA-256 checksum of a file
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// walkInstallDirectory gathers the statistics for one install directory, and records any files that aren't owned by
+// the expected user, or that are world-writable
+func walkInstallDirectory(mmDir string, name string, ownerUID uint32, unexpected *[]string) (*directoryStats, error) {
+	stats := &directoryStats{}
+	err := filepath.WalkDir(filepath.Join(mmDir, name), func(path string, entry fs.DirEntry, err error) error {
+		relative, _ := filepath.Rel(mmDir, path)
+		if err != nil {
+			*unexpected = append(*unexpected, fmt.Sprintf("%s: %s", relative, err.Error()))
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		if uid, _, ok := fileOwnership(info); ok && uid != ownerUID {
+			*unexpected = append(*unexpected, fmt.Sprintf("%s: owned by %s", relative, lookupUsername(strconv.FormatUint(uint64(uid), 10))))
+		}
+		if info.Mode()&0002 != 0 && info.Mode()&fs.ModeSymlink == 0 {
+			*unexpected = append(*unexpected, fmt.Sprintf("%s: world-writable (%s)", relative, info.Mode().String()))
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+		if stats.Oldest.IsZero() || info.ModTime().Before(stats.Oldest) {
+			stats.Oldest = info.ModTime()
+		}
+		if info.ModTime().After(stats.Newest) {
+			stats.Newest = info.ModTime()
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// findUpgradeBackups looks for copies of the install directory left behind by upgrades, both alongside the install
+// directory and inside it
+func findUpgradeBackups(mmDir string) []string {
+	var backups []string
+	for _, dir := range []string{filepath.Dir(mmDir), mmDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() && path != filepath.Clean(mmDir) && upgradeBackupPattern.MatchString(entry.Name()) {
+				backups = append(backups, path)
+			}
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+// CheckInstallIntegrity examines the Mattermost install directory for signs of a broken or partial upgrade, which is
+// a common reason for Mattermost failing to start.  It records the number and total size of the files in each of the
+// directories that come from the release archive (bin, client, prepackaged_plugins, i18n, fonts and templates),
+// checks that the files Mattermost needs to start are present, computes SHA-256 checksums of everything in bin (so
+// they can be compared with the published release), flags files that aren't owned by the owner of the install
+// directory or that are world-writable, and looks for backup directories left behind by previous upgrades.  If the
+// server binary and the webapp were modified far apart, they probably come from different releases.
+// The Mattermost directory and the temp directory are passed as parameters, and the function returns an error object
+// (nil on success).
+// The result is written to install-integrity.txt in the temp directory.
+func CheckInstallIntegrity(mmDir string, targetDir string) error {
+	DebugPrint("Checking installation integrity - writing to: " + targetDir)
+
+	info, err := os.Stat(mmDir)
+	if err != nil {
+		LogMessage(errorLevel, "Unable to examine install directory: "+mmDir)
+		return errors.New(err.Error())
+	}
+	ownerUID, _, _ := fileOwnership(info)
+	owner := lookupUsername(strconv.FormatUint(uint64(ownerUID), 10))
+
+	file, err := os.Create(targetDir + "/install-integrity.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for installation integrity in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "Installation Integrity\n======================\n")
+	fmt.Fprintf(file, "Install Directory: %s\n", mmDir)
+	fmt.Fprintf(file, "Owner:             %s\n", owner)
+
+	// File counts and sizes for each directory from the release archive
+	fmt.Fprintf(file, "\nDirectories\n-----------\n")
+	fmt.Fprintf(file, "%-20s %8s %10s  %-25s  %s\n", "DIRECTORY", "FILES", "SIZE", "OLDEST", "NEWEST")
+	var unexpected []string
+	for _, name := range installDirectories {
+		if _, err := os.Stat(filepath.Join(mmDir, name)); err != nil {
+			fmt.Fprintf(file, "%-20s MISSING\n", name+"/")
+			AddSummaryFinding(errorLevel, integrityArea, "The "+name+" directory is missing from the install directory - the install or upgrade may be incomplete")
+			continue
+		}
+		stats, err := walkInstallDirectory(mmDir, name, ownerUID, &unexpected)
+		if err != nil {
+			fmt.Fprintf(file, "%-20s ERROR: %s\n", name+"/", err.Error())
+			continue
+		}
+		if stats.Files == 0 {
+			fmt.Fprintf(file, "%-20s %8d\n", name+"/", 0)
+			AddSummaryFinding(errorLevel, integrityArea, "The "+name+" directory is empty - the install or upgrade may be incomplete")
+			continue
+		}
+		fmt.Fprintf(file, "%-20s %8d %10s  %-25s  %s\n", name+"/", stats.Files, formatBytes(stats.Bytes), stats.Oldest.Format(time.RFC3339), stats.Newest.Format(time.RFC3339))
+	}
+
+	// Files needed to start
+	fmt.Fprintf(file, "\nRequired Files\n--------------\n")
+	for _, name := range requiredInstallFiles {
+		if _, err := os.Stat(filepath.Join(mmDir, name)); err != nil {
+			fmt.Fprintf(file, "%-20s MISSING\n", name)
+			AddSummaryFinding(errorLevel, integrityArea, name+" is missing from the install directory")
+		} else {
+			fmt.Fprintf(file, "%-20s present\n", name)
+		}
+	}
+
+	// A server binary and webapp from different releases suggests files from an upgrade were only partly copied
+	binaryInfo, binaryErr := os.Stat(filepath.Join(mmDir, "bin", "mattermost"))
+	webappInfo, webappErr := os.Stat(filepath.Join(mmDir, "client", "root.html"))
+	if binaryErr == nil && webappErr == nil {
+		spread := binaryInfo.ModTime().Sub(webappInfo.ModTime())
+		if spread < 0 {
+			spread = -spread
+		}
+		if spread > maxReleaseSpread {
+			fmt.Fprintf(file, "\nWARNING: bin/mattermost and client/root.html were modified %d days apart\n", int(spread.Hours()/24))
+			AddSummaryFinding(warningLevel, integrityArea, fmt.Sprintf("bin/mattermost and client/root.html were modified %d days apart - they may come from different releases", int(spread.Hours()/24)))
+		}
+	}
+
+	// Checksums of the binaries
+	fmt.Fprintf(file, "\nSHA-256 Checksums\n-----------------\n")
+	binaries, _ := os.ReadDir(filepath.Join(mmDir, "bin"))
+	for _, entry := range binaries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		checksum, err := sha256File(filepath.Join(mmDir, "bin", entry.Name()))
+		if err != nil {
+			checksum = "ERROR: " + err.Error()
+		}
+		fmt.Fprintf(file, "%s  bin/%s\n", checksum, entry.Name())
+	}
+
+	// Files with unexpected owners or modes
+	fmt.Fprintf(file, "\nUnexpected Owners or Modes\n--------------------------\n")
+	if len(unexpected) == 0 {
+		fmt.Fprintf(file, "None - all files are owned by %s\n", owner)
+	} else {
+		for index, entry := range unexpected {
+			if index == maxListedFiles {
+				fmt.Fprintf(file, "... and %d more\n", len(unexpected)-maxListedFiles)
+				break
+			}
+			fmt.Fprintf(file, "%s\n", entry)
+		}
+		AddSummaryFinding(warningLevel, integrityArea, fmt.Sprintf("%d files in the install directory have unexpected owners or modes - see install-integrity.txt", len(unexpected)))
+	}
+
+	// Backups left behind by previous upgrades
+	fmt.Fprintf(file, "\nUpgrade Backups\n---------------\n")
+	backups := findUpgradeBackups(mmDir)
+	if len(backups) == 0 {
+		fmt.Fprintf(file, "None found\n")
+	} else {
+		for _, backup := range backups {
+			fmt.Fprintf(file, "%s\n", backup)
+		}
+		AddSummaryFinding(infoLevel, integrityArea, fmt.Sprintf("Found %d backup directories from previous upgrades - see install-integrity.txt", len(backups)))
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+// Package main contains the systemd journal collector
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+)
+
+// journalRelatedUnits lists the units (as journalctl patterns) whose messages are collected alongside Mattermost's,
+// as problems with the database or reverse proxy frequently show up as Mattermost failures.
+var journalRelatedUnits = []string{"postgresql*", "mysql*", "mariadb*", "nginx*", "apache2*", "httpd*", "haproxy*"}
+
+// oomMessagePattern matches the kernel messages logged when the OOM killer is invoked
+var oomMessagePattern = regexp.MustCompile(`(?i)out of memory|oom-kill|oom_reaper|invoked oom-killer|killed process|memory cgroup out of memory`)
+
+// journalOptions controls which journal entries are collected, and in what format
+type journalOptions struct {
+	Since string
+	Until string
+	JSON  bool
+}
+
+// journalBoots maps the boots we collect to the journalctl boot offset.  The previous boot is useful when the
+// server has been rebooted to try and recover from a crash loop.
+var journalBoots = []struct {
+	Name   string
+	Offset string
+}{
+	{"current-boot", "0"},
+	{"previous-boot", "-1"},
+}
+
+// journalTimeArgs returns the journalctl arguments for the configured time bounds
+func journalTimeArgs(options journalOptions) []string {
+	var args []string
+	if options.Since != "" {
+		args = append(args, "--since", options.Since)
+	}
+	if options.Until != "" {
+		args = append(args, "--until", options.Until)
+	}
+	return args
+}
+
+// collectKernelOOMMessages extracts OOM killer messages from the kernel log for the given boot.  We filter the
+// messages ourselves, rather than using `journalctl --grep`, as not all distros build journalctl with PCRE support.
+func collectKernelOOMMessages(bootOffset string, options journalOptions, outputFile string) error {
+	args := append([]string{"-k", "-b", bootOffset, "--no-pager", "-o", "short-iso"}, journalTimeArgs(options)...)
+
+	cmd := exec.Command("journalctl", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error())
+	}
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	matches := 0
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if oomMessagePattern.MatchString(scanner.Text()) {
+			fmt.Fprintln(file, scanner.Text())
+			matches++
+		}
+	}
+	if matches == 0 {
+		fmt.Fprintln(file, "No OOM killer messages found.")
+	}
+
+	return nil
+}
+
+// CollectJournal collects journal messages for the Mattermost unit and related units (database, reverse proxy),
+// along with kernel OOM killer messages, for both the current and the previous boot.  Collection can be bounded in
+// time, and the journal can additionally be written in JSON format for machine analysis.
+// The name of the service, the journal options and the temp directory are passed in as parameters and we return a
+// bool to indicate complete success (true) or failure of one or more steps (false).
+// The information is written to the journal directory in the temp directory.
+func CollectJournal(serviceName string, options journalOptions, targetDir string) bool {
+	DebugPrint("Collecting journal for " + serviceName + " - writing to: " + targetDir)
+
+	noErrors := true
+
+	journalDir := targetDir + "/journal"
+	if err := os.MkdirAll(journalDir, 0755); err != nil {
+		LogMessage(warningLevel, "Failed to create directory: "+journalDir)
+		return false
+	}
+
+	unitArgs := []string{"-u", serviceName}
+	for _, unit := range journalRelatedUnits {
+		unitArgs = append(unitArgs, "-u", unit)
+	}
+
+	for _, boot := range journalBoots {
+		baseArgs := append([]string{"-b", boot.Offset, "--no-pager"}, journalTimeArgs(options)...)
+		baseArgs = append(baseArgs, unitArgs...)
+
+		// There won't be a previous boot if the journal isn't persistent, or if this is the first boot
+		isCurrentBoot := boot.Offset == "0"
+
+		err := runCommandToFile(journalDir+"/"+boot.Name+".txt", "journalctl", append(baseArgs, "-o", "short-iso")...)
+		if err != nil {
+			if isCurrentBoot {
+				LogMessage(warningLevel, "Failed to generate output from journalctl for the "+boot.Name+": "+err.Error())
+				noErrors = false
+			} else {
+				DebugPrint("No journal available for the " + boot.Name + ": " + err.Error())
+			}
+			continue
+		}
+
+		if options.JSON {
+			err = runCommandToFile(journalDir+"/"+boot.Name+".json", "journalctl", append(baseArgs, "-o", "json")...)
+			if err != nil {
+				LogMessage(warningLevel, "Failed to generate JSON output from journalctl for the "+boot.Name+": "+err.Error())
+				noErrors = false
+			}
+		}
+
+		err = collectKernelOOMMessages(boot.Offset, options, journalDir+"/"+boot.Name+"-kernel-oom.txt")
+		if err != nil && isCurrentBoot {
+			LogMessage(warningLevel, "Failed to collect kernel OOM messages: "+err.Error())
+			noErrors = false
+		}
+	}
+
+	return noErrors
+}
@@ -0,0 +1,855 @@
+// Package main contains the collector for Mattermost deployments running on Kubernetes (e.g. via the Mattermost Operator)
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// kubernetesArea is the area name used for summary findings relating to Kubernetes
+const kubernetesArea = "Kubernetes"
+
+const (
+	// kubernetesAPITimeout limits how long a single Kubernetes API request can take
+	kubernetesAPITimeout = 1 * time.Minute
+	// kubernetesLogTailLines is the number of lines of output we collect from each container
+	kubernetesLogTailLines = "10000"
+	// serviceAccountDir holds the credentials mounted into pods, used when we're running inside the cluster
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// mattermostResources lists the Mattermost custom resources created by the Mattermost Operator, newest first.  The
+// older ClusterInstallation resource is still found on long-lived installs.
+var mattermostResources = []struct {
+	Name string
+	Path string
+}{
+	{"mattermosts", "/apis/installation.mattermost.com/v1beta1/namespaces/%s/mattermosts"},
+	{"clusterinstallations", "/apis/mattermost.com/v1alpha1/namespaces/%s/clusterinstallations"},
+}
+
+// kubeconfig holds the parts of a kubeconfig file needed to connect to the cluster
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+			TLSServerName            string `json:"tls-server-name"`
+		}
+	}
+	Contexts []struct {
+		Name    string
+		Context struct {
+			Cluster   string
+			User      string
+			Namespace string
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         string `json:"client-key-data"`
+			Username              string
+			Password              string
+			Exec                  *struct {
+				APIVersion string `json:"apiVersion"`
+				Command    string
+				Args       []string
+				Env        []struct {
+					Name  string
+					Value string
+				}
+			}
+		}
+	}
+}
+
+// kubernetesClient is a minimal client for the Kubernetes API, so that we don't depend on kubectl or a client library
+type kubernetesClient struct {
+	server     string
+	httpClient *http.Client
+	token      string
+	username   string
+	password   string
+	namespace  string
+}
+
+// defaultKubeconfigPath returns the first path in KUBECONFIG, or ~/.kube/config
+func defaultKubeconfigPath() string {
+	if paths := os.Getenv("KUBECONFIG"); paths != "" {
+		return filepath.SplitList(paths)[0]
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kube", "config")
+}
+
+// loadKubeconfig reads a kubeconfig file.  We only have the standard library to work with, so JSON kubeconfigs are
+// parsed directly, and YAML ones are converted to JSON using kubectl (if it's available).
+func loadKubeconfig(path string) (*kubeconfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		if !commandExists("kubectl") {
+			return nil, errors.New("kubeconfig is in YAML format and kubectl is not available to read it - convert it to JSON with `kubectl config view --raw -o json`")
+		}
+		DebugPrint("Converting kubeconfig to JSON using kubectl")
+		content, err = exec.Command("kubectl", "config", "view", "--kubeconfig", path, "--raw", "-o", "json").Output()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read kubeconfig with kubectl: %w", err)
+		}
+	}
+
+	var config kubeconfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse kubeconfig: %w", err)
+	}
+	return &config, nil
+}
+
+// readKubeconfigData returns the contents of a certificate or key, which may be given inline (base64 encoded) or as
+// a file.  Relative file paths are relative to the kubeconfig file.
+func readKubeconfigData(data string, file string, kubeconfigDir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(kubeconfigDir, file)
+	}
+	return os.ReadFile(file)
+}
+
+// runExecCredentialPlugin runs a client-go credential plugin (e.g. `aws eks get-token`) and returns the token it
+// provides.
+func runExecCredentialPlugin(command string, args []string, env []string, apiVersion string) (string, error) {
+	DebugPrint("Running credential plugin: " + command)
+
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Env = append(cmd.Env, `KUBERNETES_EXEC_INFO={"apiVersion":"`+apiVersion+`","kind":"ExecCredential","spec":{"interactive":false}}`)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("credential plugin %s failed: %w", command, err)
+	}
+
+	var credential struct {
+		Status struct {
+			Token string
+		}
+	}
+	if err := json.Unmarshal(output, &credential); err != nil || credential.Status.Token == "" {
+		return "", fmt.Errorf("credential plugin %s did not return a token", command)
+	}
+	return credential.Status.Token, nil
+}
+
+// newKubernetesClientFromKubeconfig creates a client for the current context of the given kubeconfig file
+func newKubernetesClientFromKubeconfig(path string) (*kubernetesClient, error) {
+	config, err := loadKubeconfig(path)
+	if err != nil {
+		return nil, err
+	}
+	kubeconfigDir := filepath.Dir(path)
+
+	client := &kubernetesClient{namespace: "default"}
+	clusterName, userName := "", ""
+	for _, context := range config.Contexts {
+		if context.Name == config.CurrentContext {
+			clusterName, userName = context.Context.Cluster, context.Context.User
+			if context.Context.Namespace != "" {
+				client.namespace = context.Context.Namespace
+			}
+		}
+	}
+	if clusterName == "" {
+		return nil, errors.New("current context '" + config.CurrentContext + "' not found in kubeconfig")
+	}
+	DebugPrint("Using kubeconfig context: " + config.CurrentContext)
+
+	tlsConfig := &tls.Config{}
+	for _, cluster := range config.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		client.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+		tlsConfig.ServerName = cluster.Cluster.TLSServerName
+
+		caData, err := readKubeconfigData(cluster.Cluster.CertificateAuthorityData, cluster.Cluster.CertificateAuthority, kubeconfigDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read cluster certificate authority: %w", err)
+		}
+		if caData != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+				return nil, errors.New("unable to parse cluster certificate authority")
+			}
+		}
+	}
+	if client.server == "" {
+		return nil, errors.New("cluster '" + clusterName + "' not found in kubeconfig")
+	}
+
+	for _, user := range config.Users {
+		if user.Name != userName {
+			continue
+		}
+		client.token = user.User.Token
+		client.username, client.password = user.User.Username, user.User.Password
+
+		if user.User.TokenFile != "" {
+			token, err := readKubeconfigData("", user.User.TokenFile, kubeconfigDir)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read token file: %w", err)
+			}
+			client.token = strings.TrimSpace(string(token))
+		}
+
+		certData, err := readKubeconfigData(user.User.ClientCertificateData, user.User.ClientCertificate, kubeconfigDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client certificate: %w", err)
+		}
+		keyData, err := readKubeconfigData(user.User.ClientKeyData, user.User.ClientKey, kubeconfigDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client key: %w", err)
+		}
+		if certData != nil && keyData != nil {
+			certificate, err := tls.X509KeyPair(certData, keyData)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+
+		if user.User.Exec != nil {
+			var env []string
+			for _, variable := range user.User.Exec.Env {
+				env = append(env, variable.Name+"="+variable.Value)
+			}
+			client.token, err = runExecCredentialPlugin(user.User.Exec.Command, user.User.Exec.Args, env, user.User.Exec.APIVersion)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	client.httpClient = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   kubernetesAPITimeout,
+	}
+	return client, nil
+}
+
+// newInClusterKubernetesClient creates a client using the service account mounted into the pod we're running in
+func newInClusterKubernetesClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside a Kubernetes cluster")
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	caData, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caData) {
+		return nil, errors.New("unable to parse service account certificate authority")
+	}
+
+	client := &kubernetesClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: "default",
+		httpClient: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}},
+			Timeout:   kubernetesAPITimeout,
+		},
+	}
+	if namespace, err := os.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+		client.namespace = strings.TrimSpace(string(namespace))
+	}
+	return client, nil
+}
+
+// get makes a request to the Kubernetes API, returning the response body if the request succeeded.  The caller is
+// responsible for closing the body.
+func (c *kubernetesClient) get(apiPath string) (io.ReadCloser, error) {
+	DebugPrint("Kubernetes API request: " + apiPath)
+
+	request, err := http.NewRequest(http.MethodGet, c.server+apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.username != "" {
+		request.SetBasicAuth(c.username, c.password)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, &kubernetesAPIError{Path: apiPath, StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return response.Body, nil
+}
+
+// kubernetesAPIError is returned when the Kubernetes API responds with an error status, so that callers can tell
+// a missing resource type (404) or a lack of permissions (403) apart from other failures.
+type kubernetesAPIError struct {
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *kubernetesAPIError) Error() string {
+	return fmt.Sprintf("%s returned %d %s: %s", e.Path, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// isKubernetesNotFound returns true if the error is a 404 from the Kubernetes API
+func isKubernetesNotFound(err error) bool {
+	var apiError *kubernetesAPIError
+	return errors.As(err, &apiError) && apiError.StatusCode == http.StatusNotFound
+}
+
+// getJSON makes a request to the Kubernetes API and decodes the JSON response into result.  The raw response is also
+// returned, so that it can be included in the support packet.
+func (c *kubernetesClient) getJSON(apiPath string, result interface{}) ([]byte, error) {
+	body, err := c.get(apiPath)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, result); err != nil {
+		return nil, fmt.Errorf("unable to parse response from %s: %w", apiPath, err)
+	}
+	return content, nil
+}
+
+// lastAppliedAnnotation is added by `kubectl apply`, and holds a copy of the whole object as a single JSON string
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// writeKubernetesList writes a list of Kubernetes objects to the support packet.  The last-applied-configuration
+// annotation duplicates the object (including any secrets in its env) inside a string, where obfuscation can't see
+// its structure, and managedFields is bookkeeping of no diagnostic value, so both are removed.
+func writeKubernetesList(outputFile string, raw []byte) error {
+	var list map[string]interface{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return err
+	}
+	if items, ok := list["items"].([]interface{}); ok {
+		for _, item := range items {
+			object, _ := item.(map[string]interface{})
+			metadata, _ := object["metadata"].(map[string]interface{})
+			if metadata == nil {
+				continue
+			}
+			delete(metadata, "managedFields")
+			if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+				delete(annotations, lastAppliedAnnotation)
+			}
+		}
+	}
+
+	content, err := json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outputFile, content, 0644)
+}
+
+// kubernetesObjectMeta holds the object metadata we report on
+type kubernetesObjectMeta struct {
+	Name              string
+	CreationTimestamp string `json:"creationTimestamp"`
+}
+
+// kubernetesContainerState is the state of a container, as reported in a pod's status
+type kubernetesContainerState struct {
+	Waiting *struct {
+		Reason  string
+		Message string
+	}
+	Running *struct {
+		StartedAt string `json:"startedAt"`
+	}
+	Terminated *struct {
+		Reason   string
+		ExitCode int `json:"exitCode"`
+	}
+}
+
+// kubernetesPodList holds the parts of a pod list we report on
+type kubernetesPodList struct {
+	Items []struct {
+		Metadata kubernetesObjectMeta
+		Spec     struct {
+			NodeName       string                  `json:"nodeName"`
+			InitContainers []struct{ Name string } `json:"initContainers"`
+			Containers     []struct{ Name string }
+		}
+		Status struct {
+			Phase             string
+			Reason            string
+			ContainerStatuses []struct {
+				Name         string
+				Ready        bool
+				RestartCount int `json:"restartCount"`
+				Image        string
+				State        kubernetesContainerState
+				LastState    kubernetesContainerState `json:"lastState"`
+			} `json:"containerStatuses"`
+		}
+	}
+}
+
+// describeContainerState returns a short description of a container's state, e.g. "waiting (CrashLoopBackOff)"
+func describeContainerState(state kubernetesContainerState) string {
+	switch {
+	case state.Waiting != nil:
+		return "waiting (" + state.Waiting.Reason + ")"
+	case state.Terminated != nil:
+		return fmt.Sprintf("terminated (%s, exit code %d)", state.Terminated.Reason, state.Terminated.ExitCode)
+	case state.Running != nil:
+		return "running"
+	default:
+		return "unknown"
+	}
+}
+
+// collectKubernetesPods writes a summary of each pod's containers, and collects the current and previous logs of every
+// container.  Containers that are crash-looping, OOM-killed or restarting are reported as summary findings.
+func collectKubernetesPods(client *kubernetesClient, namespace string, kubernetesDir string) error {
+	var pods kubernetesPodList
+	raw, err := client.getJSON("/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods", &pods)
+	if err != nil {
+		return err
+	}
+	if err := writeKubernetesList(kubernetesDir+"/pods.json", raw); err != nil {
+		LogMessage(warningLevel, "Failed to write pod definitions: "+err.Error())
+	}
+
+	file, err := os.Create(kubernetesDir + "/pods.txt")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := tabwriter.NewWriter(file, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "POD\tPHASE\tNODE\tCONTAINER\tREADY\tRESTARTS\tSTATE\tLAST STATE\tIMAGE\n")
+	for _, pod := range pods.Items {
+		name := pod.Metadata.Name
+		if pod.Status.Phase != "Running" && pod.Status.Phase != "Succeeded" {
+			AddSummaryFinding(warningLevel, kubernetesArea, strings.TrimSpace(fmt.Sprintf("Pod %s is %s %s", name, pod.Status.Phase, pod.Status.Reason)))
+		}
+
+		for _, container := range pod.Status.ContainerStatuses {
+			lastState := "-"
+			if container.LastState.Terminated != nil {
+				lastState = describeContainerState(container.LastState)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%d\t%s\t%s\t%s\n", name, pod.Status.Phase, pod.Spec.NodeName,
+				container.Name, container.Ready, container.RestartCount, describeContainerState(container.State), lastState, container.Image)
+
+			if container.State.Waiting != nil && container.State.Waiting.Reason != "ContainerCreating" && container.State.Waiting.Reason != "PodInitializing" {
+				AddSummaryFinding(errorLevel, kubernetesArea, fmt.Sprintf("Container %s in pod %s is waiting: %s", container.Name, name, container.State.Waiting.Reason))
+			}
+			if container.LastState.Terminated != nil && container.LastState.Terminated.Reason == "OOMKilled" {
+				AddSummaryFinding(errorLevel, kubernetesArea, fmt.Sprintf("Container %s in pod %s was OOM-killed - check its memory limit", container.Name, name))
+			}
+			if container.RestartCount > 0 {
+				AddSummaryFinding(warningLevel, kubernetesArea, fmt.Sprintf("Container %s in pod %s has restarted %d times", container.Name, name, container.RestartCount))
+			}
+		}
+	}
+	w.Flush()
+
+	// Collect the logs of every container, including init containers, and the previous instance of any container
+	// that has restarted
+	for _, pod := range pods.Items {
+		podLogDir := filepath.Join(kubernetesDir, "logs", pod.Metadata.Name)
+		if err := os.MkdirAll(podLogDir, 0755); err != nil {
+			LogMessage(warningLevel, "Failed to create directory: "+podLogDir)
+			continue
+		}
+
+		restarts := make(map[string]int)
+		for _, container := range pod.Status.ContainerStatuses {
+			restarts[container.Name] = container.RestartCount
+		}
+
+		var containers []string
+		for _, container := range pod.Spec.InitContainers {
+			containers = append(containers, container.Name)
+		}
+		for _, container := range pod.Spec.Containers {
+			containers = append(containers, container.Name)
+		}
+
+		for _, container := range containers {
+			if err := collectKubernetesContainerLogs(client, namespace, pod.Metadata.Name, container, false, filepath.Join(podLogDir, container+".log")); err != nil {
+				LogMessage(warningLevel, "Failed to collect logs for container "+container+" in pod "+pod.Metadata.Name+": "+err.Error())
+			}
+			if restarts[container] > 0 {
+				if err := collectKubernetesContainerLogs(client, namespace, pod.Metadata.Name, container, true, filepath.Join(podLogDir, container+".previous.log")); err != nil {
+					LogMessage(warningLevel, "Failed to collect previous logs for container "+container+" in pod "+pod.Metadata.Name+": "+err.Error())
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectKubernetesContainerLogs writes the output of a container (i.e. what `kubectl logs` would show).  If previous
+// is true, the output of the previous instance of the container is collected instead - this is usually where the
+// reason for a crash can be found.
+func collectKubernetesContainerLogs(client *kubernetesClient, namespace string, pod string, container string, previous bool, outputFile string) error {
+	query := url.Values{}
+	query.Set("container", container)
+	query.Set("timestamps", "true")
+	query.Set("tailLines", kubernetesLogTailLines)
+	if previous {
+		query.Set("previous", "true")
+	}
+
+	body, err := client.get("/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods/" + url.PathEscape(pod) + "/log?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, body)
+	return err
+}
+
+// kubernetesEvent holds the parts of an event we report on
+type kubernetesEvent struct {
+	Metadata       kubernetesObjectMeta
+	Type           string
+	Reason         string
+	Message        string
+	Count          int
+	LastTimestamp  string `json:"lastTimestamp"`
+	EventTime      string `json:"eventTime"`
+	InvolvedObject struct {
+		Kind string
+		Name string
+	} `json:"involvedObject"`
+}
+
+// time returns the most relevant timestamp for an event.  Depending on the version of Kubernetes and the component
+// that created the event, only some of these are set.
+func (e kubernetesEvent) time() string {
+	switch {
+	case e.LastTimestamp != "":
+		return e.LastTimestamp
+	case e.EventTime != "":
+		return e.EventTime
+	default:
+		return e.Metadata.CreationTimestamp
+	}
+}
+
+// collectKubernetesEvents writes the events in the namespace, oldest first.  Events explain most scheduling, image
+// and probe failures.
+func collectKubernetesEvents(client *kubernetesClient, namespace string, outputFile string) error {
+	var events struct {
+		Items []kubernetesEvent
+	}
+	if _, err := client.getJSON("/api/v1/namespaces/"+url.PathEscape(namespace)+"/events", &events); err != nil {
+		return err
+	}
+	sort.SliceStable(events.Items, func(i, j int) bool { return events.Items[i].time() < events.Items[j].time() })
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	warnings := 0
+	w := tabwriter.NewWriter(file, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TIME\tTYPE\tREASON\tOBJECT\tCOUNT\tMESSAGE\n")
+	for _, event := range events.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s/%s\t%d\t%s\n", event.time(), event.Type, event.Reason,
+			event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Count, strings.ReplaceAll(event.Message, "\n", " "))
+		if event.Type == "Warning" {
+			warnings++
+		}
+	}
+	w.Flush()
+
+	if warnings > 0 {
+		AddSummaryFinding(warningLevel, kubernetesArea, fmt.Sprintf("%d warning events in namespace %s - see kubernetes/events.txt", warnings, namespace))
+	}
+	return nil
+}
+
+// collectKubernetesDataKeys lists the config maps or secrets in the namespace, with the names of their keys.  The
+// values are never written to the support packet.
+func collectKubernetesDataKeys(client *kubernetesClient, apiPath string, outputFile string) error {
+	var list struct {
+		Items []struct {
+			Metadata   kubernetesObjectMeta
+			Type       string
+			Data       map[string]interface{}
+			BinaryData map[string]interface{} `json:"binaryData"`
+		}
+	}
+	if _, err := client.getJSON(apiPath, &list); err != nil {
+		return err
+	}
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := tabwriter.NewWriter(file, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tTYPE\tCREATED\tKEYS\n")
+	for _, item := range list.Items {
+		var keys []string
+		for key := range item.Data {
+			keys = append(keys, key)
+		}
+		for key := range item.BinaryData {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", item.Metadata.Name, item.Type, item.Metadata.CreationTimestamp, strings.Join(keys, ", "))
+	}
+	return w.Flush()
+}
+
+// collectKubernetesVolumeClaims writes the status of the persistent volume claims in the namespace, and reports any
+// that aren't bound.
+func collectKubernetesVolumeClaims(client *kubernetesClient, namespace string, outputFile string) error {
+	var claims struct {
+		Items []struct {
+			Metadata kubernetesObjectMeta
+			Spec     struct {
+				StorageClassName string   `json:"storageClassName"`
+				AccessModes      []string `json:"accessModes"`
+				VolumeName       string   `json:"volumeName"`
+			}
+			Status struct {
+				Phase    string
+				Capacity map[string]string
+			}
+		}
+	}
+	if _, err := client.getJSON("/api/v1/namespaces/"+url.PathEscape(namespace)+"/persistentvolumeclaims", &claims); err != nil {
+		return err
+	}
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := tabwriter.NewWriter(file, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tSTATUS\tVOLUME\tCAPACITY\tACCESS MODES\tSTORAGE CLASS\n")
+	for _, claim := range claims.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", claim.Metadata.Name, claim.Status.Phase, claim.Spec.VolumeName,
+			claim.Status.Capacity["storage"], strings.Join(claim.Spec.AccessModes, ","), claim.Spec.StorageClassName)
+		if claim.Status.Phase != "Bound" {
+			AddSummaryFinding(errorLevel, kubernetesArea, "Persistent volume claim "+claim.Metadata.Name+" is "+claim.Status.Phase)
+		}
+	}
+	return w.Flush()
+}
+
+// collectMattermostResources writes the Mattermost custom resources in the namespace, reports any installation that
+// isn't stable, and returns the ingress hostname of the first installation (so that it can be obfuscated).
+func collectMattermostResources(client *kubernetesClient, namespace string, kubernetesDir string) (string, error) {
+	ingressHost := ""
+	found := false
+
+	for _, resource := range mattermostResources {
+		var list struct {
+			Items []struct {
+				Metadata kubernetesObjectMeta
+				Spec     struct {
+					IngressName string `json:"ingressName"`
+					Ingress     *struct {
+						Host string
+					}
+				}
+				Status struct {
+					State   string
+					Version string
+				}
+			}
+		}
+		raw, err := client.getJSON(fmt.Sprintf(resource.Path, url.PathEscape(namespace)), &list)
+		if err != nil {
+			if isKubernetesNotFound(err) {
+				DebugPrint("Mattermost resource type " + resource.Name + " is not installed")
+				continue
+			}
+			return ingressHost, err
+		}
+		if len(list.Items) == 0 {
+			continue
+		}
+		found = true
+
+		if err := writeKubernetesList(filepath.Join(kubernetesDir, resource.Name+".json"), raw); err != nil {
+			LogMessage(warningLevel, "Failed to write "+resource.Name+": "+err.Error())
+		}
+		for _, item := range list.Items {
+			if item.Status.State != "" && item.Status.State != "stable" {
+				AddSummaryFinding(warningLevel, kubernetesArea, "Mattermost installation "+item.Metadata.Name+" is "+item.Status.State+" (version "+item.Status.Version+")")
+			}
+			if ingressHost == "" {
+				if item.Spec.Ingress != nil && item.Spec.Ingress.Host != "" {
+					ingressHost = item.Spec.Ingress.Host
+				} else {
+					ingressHost = item.Spec.IngressName
+				}
+			}
+		}
+	}
+
+	if !found {
+		LogMessage(warningLevel, "No Mattermost custom resources found in namespace "+namespace)
+		AddSummaryFinding(warningLevel, kubernetesArea, "No Mattermost custom resources were found in namespace "+namespace+" - use --namespace if Mattermost is elsewhere")
+	}
+	return ingressHost, nil
+}
+
+// CollectKubernetesDeployment collects information about Mattermost running on Kubernetes (typically installed by the
+// Mattermost Operator) from the Kubernetes API, using the current context of the given kubeconfig.  If no kubeconfig
+// is available, the service account of the pod we're running in is used instead.  For the namespace (or the
+// context's namespace, if none is given), we collect: the Mattermost custom resources, pods and their current and
+// previous container logs, events, config maps and secrets (names and keys only), persistent volume claims and
+// ingresses.
+// The kubeconfig path, namespace and temp directory are passed as parameters.  The function returns the ingress
+// hostname of the Mattermost installation (if any) and an error object (nil on success).
+// The information is written to the kubernetes directory in the temp directory.
+func CollectKubernetesDeployment(kubeconfigPath string, namespace string, targetDir string) (string, error) {
+	DebugPrint("Collecting Kubernetes deployment information")
+
+	var client *kubernetesClient
+	var err error
+	if _, statErr := os.Stat(kubeconfigPath); kubeconfigPath != "" && statErr == nil {
+		client, err = newKubernetesClientFromKubeconfig(kubeconfigPath)
+	} else {
+		DebugPrint("No kubeconfig found at '" + kubeconfigPath + "' - trying in-cluster service account")
+		client, err = newInClusterKubernetesClient()
+	}
+	if err != nil {
+		LogMessage(errorLevel, "Unable to connect to the Kubernetes API: "+err.Error())
+		AddSummaryFinding(errorLevel, kubernetesArea, "Unable to connect to the Kubernetes API - use --kubeconfig to specify a kubeconfig")
+		return "", errors.New(err.Error())
+	}
+	if namespace == "" {
+		namespace = client.namespace
+	}
+	LogMessage(infoLevel, "Collecting from namespace "+namespace+" on "+client.server)
+
+	kubernetesDir := targetDir + "/kubernetes"
+	if err := os.MkdirAll(kubernetesDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+kubernetesDir)
+		return "", errors.New(err.Error())
+	}
+
+	var version map[string]interface{}
+	raw, err := client.getJSON("/version", &version)
+	if err != nil {
+		LogMessage(errorLevel, "Unable to connect to the Kubernetes API on "+client.server)
+		AddSummaryFinding(errorLevel, kubernetesArea, "Unable to connect to the Kubernetes API: "+err.Error())
+		return "", errors.New(err.Error())
+	}
+	if err := os.WriteFile(kubernetesDir+"/version.json", raw, 0644); err != nil {
+		LogMessage(warningLevel, "Failed to write Kubernetes version information: "+err.Error())
+	}
+
+	ingressHost, err := collectMattermostResources(client, namespace, kubernetesDir)
+	if err != nil {
+		LogMessage(warningLevel, "Failed to collect Mattermost custom resources: "+err.Error())
+	}
+
+	if err := collectKubernetesPods(client, namespace, kubernetesDir); err != nil {
+		LogMessage(warningLevel, "Failed to collect pods: "+err.Error())
+	}
+	if err := collectKubernetesEvents(client, namespace, kubernetesDir+"/events.txt"); err != nil {
+		LogMessage(warningLevel, "Failed to collect events: "+err.Error())
+	}
+	if err := collectKubernetesDataKeys(client, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/configmaps", kubernetesDir+"/configmaps.txt"); err != nil {
+		LogMessage(warningLevel, "Failed to collect config maps: "+err.Error())
+	}
+	if err := collectKubernetesDataKeys(client, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/secrets", kubernetesDir+"/secrets.txt"); err != nil {
+		LogMessage(warningLevel, "Failed to collect secrets: "+err.Error())
+	}
+	if err := collectKubernetesVolumeClaims(client, namespace, kubernetesDir+"/pvcs.txt"); err != nil {
+		LogMessage(warningLevel, "Failed to collect persistent volume claims: "+err.Error())
+	}
+
+	var ingresses map[string]interface{}
+	if raw, err := client.getJSON("/apis/networking.k8s.io/v1/namespaces/"+url.PathEscape(namespace)+"/ingresses", &ingresses); err != nil {
+		LogMessage(warningLevel, "Failed to collect ingresses: "+err.Error())
+	} else if err := writeKubernetesList(kubernetesDir+"/ingresses.json", raw); err != nil {
+		LogMessage(warningLevel, "Failed to write ingresses: "+err.Error())
+	}
+
+	return ingressHost, nil
+}
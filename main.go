@@ -14,6 +14,7 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,8 +29,26 @@ type LogLevel string
 
 // Creating this as a struct already in case we need to extract additional items from the config file
 type mmConfig struct {
-	LogDirectory string
-	ListenPort   string
+	LogDirectory         string
+	ListenPort           string
+	SiteURL              string
+	SMTPServer           string
+	LdapServer           string
+	ConnectionSecurity   string
+	TLSCertFile          string
+	TLSKeyFile           string
+	UseLetsEncrypt       bool
+	MaxFileSize          int64
+	FileDriverName       string
+	FileDirectory        string
+	MetricsEnabled       bool
+	MetricsListenAddress string
+	SQLMaxOpenConns      int
+	SQLDriverName        string
+	PluginsEnabled       bool
+	PluginDirectory      string
+	PluginClientDir      string
+	PluginStates         map[string]bool
 }
 
 const (
@@ -37,6 +56,8 @@ const (
 	defaultPacketProfix  = "support-packet"
 	defaultTargetDir     = "/tmp"
 	defaultListenPort    = "8065"
+	defaultMaxFileSize   = 104857600
+	defaultServiceName   = "mattermost.service"
 )
 
 const (
@@ -89,6 +110,48 @@ func getEnvWithDefault(key string, defaultValue interface{}) interface{} {
 	return value
 }
 
+// getEnvBoolWithDefault retrieves a boolean Environment variable, returning the supplied default if the variable
+// is not set or can't be parsed as a boolean (e.g. "true", "1", "false", "0").
+func getEnvBoolWithDefault(key string, defaultValue bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		LogMessage(warningLevel, "Unable to parse environment variable "+key+" as a boolean.  Using default.")
+		return defaultValue
+	}
+	return boolValue
+}
+
+// getEnvIntWithDefault retrieves an integer Environment variable, returning the supplied default if the variable
+// is not set or can't be parsed as an integer.
+func getEnvIntWithDefault(key string, defaultValue int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		LogMessage(warningLevel, "Unable to parse environment variable "+key+" as an integer.  Using default.")
+		return defaultValue
+	}
+	return intValue
+}
+
+// isFlagPassed reports whether the named flag was set on the command line, for flags where the zero value is
+// meaningful and so can't be used to detect that the flag wasn't supplied.
+func isFlagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
 // fileExists is a utility function to validate that a file exists and is not a directory.  Returns true/false.
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -117,6 +180,37 @@ func dirExists(dirname string) bool {
 	return true
 }
 
+// resolveMattermostPath resolves a path taken from the Mattermost config file.  Relative paths (e.g. "./data/") are
+// relative to the Mattermost install directory, which is the working directory of the service.
+func resolveMattermostPath(mmDir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(mmDir, path)
+}
+
+// runCommandToFile runs a command, writing both its stdout and stderr to the given file.  It returns an error object
+// if the file can't be created or the command fails.
+func runCommandToFile(outputFile string, name string, args ...string) error {
+	DebugPrint("Running '" + name + " " + strings.Join(args, " ") + "' - writing to: " + outputFile)
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = file
+	cmd.Stderr = file
+
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error())
+	}
+
+	return nil
+}
+
 // checkPackage is used to check whether a utility is available on the current linux distro in use.
 // In many cases, the command to be checked for (passed in as a parameter) is its own package, but in
 // a few special cases, commands exist as part of a larger suite.  For these cases, we need to maintain
@@ -228,10 +322,6 @@ func (confFile *mmConfig) ProcessConfigFile(configPath string, mmDir string) err
 		}
 	}
 
-	if !dirExists(confFile.LogDirectory) {
-		return errors.New("specified log directory does exist")
-	}
-
 	// Extract the listen port
 	if serviceSettings, ok := result["ServiceSettings"].(map[string]interface{}); ok {
 		if listenPort, ok := serviceSettings["ListenAddress"].(string); ok {
@@ -248,6 +338,97 @@ func (confFile *mmConfig) ProcessConfigFile(configPath string, mmDir string) err
 				LogMessage(infoLevel, "Using listen port from config file: "+confFile.ListenPort)
 			}
 		}
+		if siteURL, ok := serviceSettings["SiteURL"].(string); ok {
+			confFile.SiteURL = siteURL
+		}
+
+		// Extract the TLS settings, in case Mattermost is terminating TLS itself
+		if connectionSecurity, ok := serviceSettings["ConnectionSecurity"].(string); ok {
+			confFile.ConnectionSecurity = connectionSecurity
+		}
+		if tlsCertFile, ok := serviceSettings["TLSCertFile"].(string); ok {
+			confFile.TLSCertFile = tlsCertFile
+		}
+		if tlsKeyFile, ok := serviceSettings["TLSKeyFile"].(string); ok {
+			confFile.TLSKeyFile = tlsKeyFile
+		}
+		if useLetsEncrypt, ok := serviceSettings["UseLetsEncrypt"].(bool); ok {
+			confFile.UseLetsEncrypt = useLetsEncrypt
+		}
+	}
+
+	// Extract the file storage settings, including the maximum upload size, which needs to be allowed for by any
+	// reverse proxy
+	confFile.MaxFileSize = defaultMaxFileSize
+	if fileSettings, ok := result["FileSettings"].(map[string]interface{}); ok {
+		if maxFileSize, ok := fileSettings["MaxFileSize"].(float64); ok {
+			confFile.MaxFileSize = int64(maxFileSize)
+		}
+		if driverName, ok := fileSettings["DriverName"].(string); ok {
+			confFile.FileDriverName = driverName
+		}
+		if directory, ok := fileSettings["Directory"].(string); ok {
+			confFile.FileDirectory = directory
+		}
+	}
+
+	// Extract the metrics settings, as the metrics server also serves the Go runtime's pprof endpoints
+	if metricsSettings, ok := result["MetricsSettings"].(map[string]interface{}); ok {
+		if enable, ok := metricsSettings["Enable"].(bool); ok {
+			confFile.MetricsEnabled = enable
+		}
+		if listenAddress, ok := metricsSettings["ListenAddress"].(string); ok {
+			confFile.MetricsListenAddress = listenAddress
+		}
+	}
+
+	// Extract the database driver, and the size of the connection pool to compare against the connections in use
+	if sqlSettings, ok := result["SqlSettings"].(map[string]interface{}); ok {
+		if maxOpenConns, ok := sqlSettings["MaxOpenConns"].(float64); ok {
+			confFile.SQLMaxOpenConns = int(maxOpenConns)
+		}
+		if driverName, ok := sqlSettings["DriverName"].(string); ok {
+			confFile.SQLDriverName = driverName
+		}
+	}
+
+	// Extract the plugin settings, including which plugins are enabled
+	confFile.PluginsEnabled = true
+	confFile.PluginStates = make(map[string]bool)
+	if pluginSettings, ok := result["PluginSettings"].(map[string]interface{}); ok {
+		if enable, ok := pluginSettings["Enable"].(bool); ok {
+			confFile.PluginsEnabled = enable
+		}
+		if directory, ok := pluginSettings["Directory"].(string); ok {
+			confFile.PluginDirectory = directory
+		}
+		if clientDirectory, ok := pluginSettings["ClientDirectory"].(string); ok {
+			confFile.PluginClientDir = clientDirectory
+		}
+		if pluginStates, ok := pluginSettings["PluginStates"].(map[string]interface{}); ok {
+			for id, state := range pluginStates {
+				if state, ok := state.(map[string]interface{}); ok {
+					enable, _ := state["Enable"].(bool)
+					confFile.PluginStates[id] = enable
+				}
+			}
+		}
+	}
+
+	// Extract the external servers we talk to.  These are mainly used to learn the customer's domains for obfuscation.
+	if emailSettings, ok := result["EmailSettings"].(map[string]interface{}); ok {
+		if smtpServer, ok := emailSettings["SMTPServer"].(string); ok {
+			confFile.SMTPServer = smtpServer
+		}
+	}
+	if ldapSettings, ok := result["LdapSettings"].(map[string]interface{}); ok {
+		if ldapServer, ok := ldapSettings["LdapServer"].(string); ok {
+			confFile.LdapServer = ldapServer
+		}
+	}
+
+	if !dirExists(confFile.LogDirectory) {
+		return errors.New("specified log directory does exist")
 	}
 
 	return nil
@@ -284,8 +465,9 @@ func createTempDir(targetDir string, namePrefix string) (string, error) {
 	return dirName, nil
 }
 
-// CopyLogFiles copies any files in the Mattermost log directory into the temp directory.  Both directories
-// are passed as parameters.  The function returns an error object if it fails, otherwise it returns nil.
+// CopyLogFiles copies the contents of the Mattermost log directory (including any subdirectories, such as those
+// used by plugins or advanced logging targets) into the temp directory.  Both directories are passed as parameters.
+// The function returns an error object if it fails, otherwise it returns nil.
 func CopyLogFiles(logFileDirectory string, targetDirectory string) error {
 	DebugPrint("Copying files from:'" + logFileDirectory + "' to: '" + targetDirectory + "'")
 
@@ -294,7 +476,7 @@ func CopyLogFiles(logFileDirectory string, targetDirectory string) error {
 
 	DebugPrint("Copying from source: " + source + " to target: " + target)
 
-	copyCommand := fmt.Sprintf("cp %s %s", source, target)
+	copyCommand := fmt.Sprintf("cp -r %s %s", source, target)
 
 	DebugPrint("Copy command: " + copyCommand)
 
@@ -328,22 +510,22 @@ func CopyConfigFile(configFileName string, targetDirectory string) error {
 }
 
 // GatherServiceMessages is a function that allows us to obtain the output of the traiditional
-// systemctl and journalctl messages that would typically be run on the command line when a service
-// fails to start.  The temp directory is passed in as a parameter and we return a bool to indicate
-// complete success (true) or failure of one or more steps (false).
-// The information is written to systemctl.txt and journalctl.txt in the temp directory.
-func GatherServiceMessages(targetDir string) bool {
+// systemctl messages that would typically be run on the command line when a service fails to start.
+// The name of the service and the temp directory are passed in as parameters and we return a bool
+// to indicate success (true) or failure (false).
+// The information is written to systemctl.txt in the temp directory.  Journal messages are collected
+// separately by CollectJournal.
+func GatherServiceMessages(serviceName string, targetDir string) bool {
 	DebugPrint("Gathering service messages - writing to: " + targetDir)
 
 	noErrors := true
 
-	// We'll write the service logs to two text files: systemctl.txt & journalctl.txt
 	sysFile, err := os.Create(targetDir + "/systemctl.txt")
 	if err != nil {
 		LogMessage(warningLevel, "Failed to create output file for systemctl output")
 		noErrors = false
 	} else {
-		cmd := exec.Command("systemctl", "status", "mattermost.service", "--no-pager", "-l")
+		cmd := exec.Command("systemctl", "status", serviceName, "--no-pager", "-l")
 		cmd.Stdout = sysFile
 		cmd.Stderr = sysFile
 
@@ -355,55 +537,9 @@ func GatherServiceMessages(targetDir string) bool {
 	}
 	defer sysFile.Close()
 
-	jnlFile, err := os.Create(targetDir + "/journalctl.txt")
-	if err != nil {
-		LogMessage(warningLevel, "Failed to create output file for journalctl output")
-		noErrors = false
-	} else {
-		cmd := exec.Command("journalctl", "-xe", "--no-pager")
-		cmd.Stdout = jnlFile
-		cmd.Stderr = jnlFile
-
-		err = cmd.Run()
-		if err != nil {
-			LogMessage(warningLevel, "Failed to generate output from journalctl: "+err.Error())
-			noErrors = false
-		}
-	}
-	defer jnlFile.Close()
-
 	return noErrors
 }
 
-// GetTopProcesses calls `top` in batch mode to gather a list of the top-running processes, just as
-// we'd expect to see when running top inderactively.  The temp directory is passed as a parameter,
-// and we return an error object.
-// The information is written to top.txt in the temp directory.
-func GetTopProcesses(targetDir string) error {
-	DebugPrint("Gathering top processes - writing to: " + targetDir)
-
-	file, err := os.Create(targetDir + "/top.txt")
-	if err != nil {
-		LogMessage(errorLevel, "Unable to create file for top processes in "+targetDir)
-		return errors.New(err.Error())
-	}
-	defer file.Close()
-
-	// The `-b` flag runs top in batch more, and `-n` allows us to specify the number of
-	// iterations - in this case, we only want 1.
-	cmd := exec.Command("top", "-b", "-n", "1")
-	cmd.Stdout = file
-	cmd.Stderr = file
-
-	err = cmd.Run()
-	if err != nil {
-		LogMessage(warningLevel, "Failed to generate output from top")
-		return errors.New(err.Error())
-	}
-
-	return nil
-}
-
 // CheckListeningPort uses either netstat or ss to see what processes (if any) are listening on the
 // port that Mattermost is trying to use.  Note that we can't be sure which package is installed
 // (if any) for these commands, so we need to figure that out first.
@@ -481,32 +617,6 @@ func CopyOSInfoFiles(targetDir string) bool {
 	return noErrors
 }
 
-// GetDiskSpace uses the OS level `df -a -h` to provide disk space information across all disks in
-// human readable form.  We expect the temp directory as a parameter, and return an error object on failure.
-// The output is written to diskspace.txt
-func GetDiskSpace(targetDir string) error {
-	DebugPrint("Getting disk space")
-
-	file, err := os.Create(targetDir + "/diskspace.txt")
-	if err != nil {
-		LogMessage(errorLevel, "Unable to create file for disk space in "+targetDir)
-		return errors.New(err.Error())
-	}
-	defer file.Close()
-
-	cmd := exec.Command("df", "-a", "-h")
-	cmd.Stdout = file
-	cmd.Stderr = file
-
-	err = cmd.Run()
-	if err != nil {
-		LogMessage(warningLevel, "Failed to generate output from df")
-		return errors.New(err.Error())
-	}
-
-	return nil
-}
-
 // CompressSupportPacket is used as the last step in the process, to take the directory containing all of the files
 // (passed om as targetDir) and to compress them into a tar.gz file in the parent directory (passed in as parentDir).
 // The function generates the name of the tar.gz file by taking the name of the temp directory and suffixing .tar.gz.
@@ -539,24 +649,48 @@ func CompressSupportPacket(targetDir string, parentDir string) (string, error) {
 
 func main() {
 
-	// Check that user is running with root privileges - abort if not!
-	if !isRoot() {
-		LogMessage(errorLevel, "'root' or 'sudo' priveleges are required to run this utility!  Please try again using 'sudo'.")
-		os.Exit(2)
-	}
-
 	// Parse command line
 	var MattermostDir string
 	var TargetDir string
 	var PkgNamePrefix string
+	var ServiceName string
+	var JournalSince string
+	var JournalUntil string
+	var JournalJSONFlag bool
 	var DebugFlag bool
 	var NoObfuscateFlag bool
+	var AllowBinaryFlag bool
+	var ObfuscateDomains string
+	var DockerFlag bool
+	var DockerSocket string
+	var KubernetesFlag bool
+	var CPUProfileSeconds int
+	var MetricsSamples int
+	var MetricsInterval int
+	var APIProbeFlag bool
+	var KubeconfigPath string
+	var Namespace string
 
 	flag.StringVar(&MattermostDir, "directory", "", "Install directory of Mattermost. [Default: "+defaultMattermostDir+"]")
 	flag.StringVar(&TargetDir, "target", "", "Target directory in which the support packet will be created. [Default: "+defaultTargetDir+"]")
 	flag.StringVar(&PkgNamePrefix, "name", "", "Prefix for name of support packet. [Default: "+defaultPacketProfix+"]")
+	flag.StringVar(&ServiceName, "service", "", "Name of the Mattermost service. [Default: "+defaultServiceName+"]")
+	flag.StringVar(&JournalSince, "journal-since", "", "Only collect journal entries on or after this time, in any format journalctl accepts (e.g. \"2 days ago\"). [Default: start of boot]")
+	flag.StringVar(&JournalUntil, "journal-until", "", "Only collect journal entries on or before this time, in any format journalctl accepts. [Default: now]")
+	flag.BoolVar(&JournalJSONFlag, "journal-json", false, "Also collect the journal in JSON format, for machine analysis.")
+	flag.IntVar(&CPUProfileSeconds, "cpu-profile", 0, "Also capture a CPU profile of this many seconds from the running server (requires metrics to be enabled). [Default: 0 (disabled)]")
+	flag.IntVar(&MetricsSamples, "metrics-samples", defaultMetricsSamples, "Number of times to scrape the Prometheus metrics of the running server (requires metrics to be enabled; 0 to disable).")
+	flag.IntVar(&MetricsInterval, "metrics-interval", defaultMetricsInterval, "Number of seconds between metrics scrapes.")
+	flag.BoolVar(&APIProbeFlag, "api", false, "Also query the running server's REST API.  Set MM_SUP_API_TOKEN to a personal access token to collect the server's own support packet.")
 	flag.BoolVar(&DebugFlag, "debug", false, "Enable debug mode.")
 	flag.BoolVar(&NoObfuscateFlag, "no-obfuscate", false, "Disable obfuscation of sensitive data in logs and config files. [Default: obfuscation enabled]")
+	flag.StringVar(&ObfuscateDomains, "obfuscate-domains", "", "Comma-separated list of additional domains to obfuscate, alongside those learned from the config file and hostname.")
+	flag.BoolVar(&DockerFlag, "docker", false, "Collect from Mattermost running in Docker, via the Docker Engine API, rather than from a host install.")
+	flag.StringVar(&DockerSocket, "docker-socket", "", "Path to the Docker Engine API socket. [Default: "+defaultDockerSocket+", or DOCKER_HOST if set]")
+	flag.BoolVar(&KubernetesFlag, "kubernetes", false, "Collect from Mattermost running on Kubernetes, via the Kubernetes API, rather than from a host install.")
+	flag.StringVar(&KubeconfigPath, "kubeconfig", "", "Path to the kubeconfig file used with -kubernetes. [Default: KUBECONFIG, or ~/.kube/config]")
+	flag.StringVar(&Namespace, "namespace", "", "Kubernetes namespace in which Mattermost is installed. [Default: namespace of the current kubeconfig context]")
+	flag.BoolVar(&AllowBinaryFlag, "allow-binary", false, "Keep unrecognised binary files in the support packet, even though they can't be obfuscated.")
 
 	flag.Parse()
 
@@ -570,25 +704,102 @@ func main() {
 	if PkgNamePrefix == "" {
 		PkgNamePrefix = getEnvWithDefault("MM_SUP_NAME", defaultPacketProfix).(string)
 	}
+	if ServiceName == "" {
+		ServiceName = getEnvWithDefault("MM_SUP_SERVICE", defaultServiceName).(string)
+	}
+	if JournalSince == "" {
+		JournalSince = getEnvWithDefault("MM_SUP_JOURNAL_SINCE", "").(string)
+	}
+	if JournalUntil == "" {
+		JournalUntil = getEnvWithDefault("MM_SUP_JOURNAL_UNTIL", "").(string)
+	}
+	if !JournalJSONFlag {
+		JournalJSONFlag = getEnvBoolWithDefault("MM_SUP_JOURNAL_JSON", false)
+	}
 	if !DebugFlag {
-		DebugFlag = getEnvWithDefault("MM_SUP_DEBUG", debugMode).(bool)
+		DebugFlag = getEnvBoolWithDefault("MM_SUP_DEBUG", debugMode)
 	}
 	debugMode = DebugFlag
 
 	if !NoObfuscateFlag {
-		NoObfuscateFlag = getEnvWithDefault("MM_SUP_NO_OBFUSCATE", false).(bool)
+		NoObfuscateFlag = getEnvBoolWithDefault("MM_SUP_NO_OBFUSCATE", false)
 	}
 	EnableObfuscation := !NoObfuscateFlag
 
-	// Validate that Mattermost is present at either the default location, or the overridden location
+	if !AllowBinaryFlag {
+		AllowBinaryFlag = getEnvBoolWithDefault("MM_SUP_ALLOW_BINARY", false)
+	}
+	allowBinaryFiles = AllowBinaryFlag
+
+	if ObfuscateDomains == "" {
+		ObfuscateDomains = getEnvWithDefault("MM_SUP_OBFUSCATE_DOMAINS", "").(string)
+	}
+
+	if !DockerFlag {
+		DockerFlag = getEnvBoolWithDefault("MM_SUP_DOCKER", false)
+	}
+	if DockerSocket == "" {
+		DockerSocket = getEnvWithDefault("MM_SUP_DOCKER_SOCKET", dockerSocketFromEnvironment()).(string)
+	}
+
+	if CPUProfileSeconds == 0 {
+		CPUProfileSeconds = getEnvIntWithDefault("MM_SUP_CPU_PROFILE", 0)
+	}
+	if CPUProfileSeconds > 0 && EnableObfuscation && !allowBinaryFiles {
+		LogMessage(warningLevel, "CPU profiles are binary, so will be removed during obfuscation unless -allow-binary is used")
+	}
+
+	// Zero is a meaningful number of samples, so we check whether the flag was used rather than for a zero value
+	if !isFlagPassed("metrics-samples") {
+		MetricsSamples = getEnvIntWithDefault("MM_SUP_METRICS_SAMPLES", defaultMetricsSamples)
+	}
+	if !isFlagPassed("metrics-interval") {
+		MetricsInterval = getEnvIntWithDefault("MM_SUP_METRICS_INTERVAL", defaultMetricsInterval)
+	}
+	if MetricsInterval < 1 {
+		LogMessage(warningLevel, fmt.Sprintf("Invalid metrics interval.  Using default of %d seconds.", defaultMetricsInterval))
+		MetricsInterval = defaultMetricsInterval
+	}
+
+	// The access token is only read from the environment, so that it isn't visible in the process list
+	if !APIProbeFlag {
+		APIProbeFlag = getEnvBoolWithDefault("MM_SUP_API", false)
+	}
+	APIToken := os.Getenv("MM_SUP_API_TOKEN")
+
+	if !KubernetesFlag {
+		KubernetesFlag = getEnvBoolWithDefault("MM_SUP_KUBERNETES", false)
+	}
+	if KubeconfigPath == "" {
+		KubeconfigPath = getEnvWithDefault("MM_SUP_KUBECONFIG", defaultKubeconfigPath()).(string)
+	}
+	if Namespace == "" {
+		Namespace = getEnvWithDefault("MM_SUP_NAMESPACE", "").(string)
+	}
+
+	if DockerFlag && KubernetesFlag {
+		LogMessage(errorLevel, "-docker and -kubernetes can't be used together!")
+		os.Exit(1)
+	}
+
+	// Check that user is running with root privileges - abort if not!  Collecting from Kubernetes only needs access to
+	// the Kubernetes API, so can be run as any user.
+	if !KubernetesFlag && !isRoot() {
+		LogMessage(errorLevel, "'root' or 'sudo' priveleges are required to run this utility!  Please try again using 'sudo'.")
+		os.Exit(2)
+	}
+
+	// Validate that Mattermost is present at either the default location, or the overridden location.  When running
+	// under Docker, the config file is inside the container, so it's collected later, and on Kubernetes there isn't one.
 	var ConfigFilePath string = MattermostDir + "/config/config.json"
+	HostInstall := !DockerFlag && !KubernetesFlag
 
-	if !fileExists(ConfigFilePath) {
+	if HostInstall && !fileExists(ConfigFilePath) {
 		LogMessage(warningLevel, "Config file not found at: "+ConfigFilePath)
 		LogMessage(infoLevel, "Attempting default configuration for config file")
 		ConfigFilePath = defaultMattermostDir + "/config/config.json"
 		if !fileExists(ConfigFilePath) {
-			LogMessage(errorLevel, "Unable to locate config file!")
+			LogMessage(errorLevel, "Unable to locate config file!  If Mattermost is running in Docker, use -docker.")
 			os.Exit(3)
 		}
 	}
@@ -596,6 +807,14 @@ func main() {
 	DebugPrint("MattermostDir: " + MattermostDir)
 	DebugPrint("TargetDir: " + TargetDir)
 	DebugPrint("PkgNamePrefix: " + PkgNamePrefix)
+	DebugPrint("ServiceName: " + ServiceName)
+	if DockerFlag {
+		DebugPrint("DockerSocket: " + DockerSocket)
+	}
+	if KubernetesFlag {
+		DebugPrint("KubeconfigPath: " + KubeconfigPath)
+		DebugPrint("Namespace: " + Namespace)
+	}
 
 	// Log obfuscation status
 	if EnableObfuscation {
@@ -605,13 +824,14 @@ func main() {
 	}
 
 	// Process config.json
-	LogMessage(infoLevel, "Analysing config file...")
 	CurrentConfig := new(mmConfig)
+	if HostInstall {
+		LogMessage(infoLevel, "Analysing config file...")
+		CurrentConfig.ProcessConfigFile(ConfigFilePath, MattermostDir)
 
-	CurrentConfig.ProcessConfigFile(ConfigFilePath, MattermostDir)
-
-	// Is the log file directory overridden via the ENVIRONMENT? [see https://docs.mattermost.com/configure/environment-configuration-settings.html#logging]
-	CurrentConfig.LogDirectory = getEnvWithDefault("MM_LOGSETTINGS_FILELOCATION", CurrentConfig.LogDirectory).(string)
+		// Is the log file directory overridden via the ENVIRONMENT? [see https://docs.mattermost.com/configure/environment-configuration-settings.html#logging]
+		CurrentConfig.LogDirectory = getEnvWithDefault("MM_LOGSETTINGS_FILELOCATION", CurrentConfig.LogDirectory).(string)
+	}
 
 	// Create a temp directory to hold the support packet.
 	tempDirectory, err := createTempDir(TargetDir, PkgNamePrefix)
@@ -621,51 +841,245 @@ func main() {
 	}
 	LogMessage(infoLevel, "Creating support packet in: "+tempDirectory)
 
-	// Copy all log files from the Mattermost directory to the temp directory
-	LogMessage(infoLevel, "Copying Mattermost log files")
-	err = CopyLogFiles(CurrentConfig.LogDirectory, tempDirectory)
-	if err != nil {
-		LogMessage(warningLevel, "Failed to copy Mattermost log files. Error: "+err.Error())
-	}
+	// The service manager is only known for host installs
+	var ServiceManager string
 
-	// Copy the config file to the temp directory
-	LogMessage(infoLevel, "Copying Mattermost config file")
-	err = CopyConfigFile(ConfigFilePath, tempDirectory)
-	if err != nil {
-		LogMessage(warningLevel, "Failed to copy the Mattermost config file. Error: "+err.Error())
-	}
+	if KubernetesFlag {
+		// Collect the Mattermost resources, pods, logs and events from Kubernetes
+		LogMessage(infoLevel, "Collecting Kubernetes deployment information")
+		var IngressHost string
+		IngressHost, err = CollectKubernetesDeployment(KubeconfigPath, Namespace, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to collect Kubernetes deployment information.  Error: "+err.Error())
+		}
+		if IngressHost != "" {
+			CurrentConfig.SiteURL = "https://" + IngressHost
+		}
+	} else if DockerFlag {
+		// Collect the containers, config and logs from Docker
+		LogMessage(infoLevel, "Collecting Docker deployment information")
+		var ContainerConfigPath, ContainerMattermostDir string
+		ContainerConfigPath, ContainerMattermostDir, err = CollectDockerDeployment(DockerSocket, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to collect Docker deployment information.  Error: "+err.Error())
+		}
 
-	// Gathering information from system services
-	LogMessage(infoLevel, "Gathering service level information")
-	if !GatherServiceMessages(tempDirectory) {
-		LogMessage(warningLevel, "Not all service information was gathered")
-	}
+		// Process the config file copied out of the container, if we have one
+		CurrentConfig.ListenPort = defaultListenPort
+		CurrentConfig.MaxFileSize = defaultMaxFileSize
+		if ContainerConfigPath != "" {
+			LogMessage(infoLevel, "Analysing config file...")
+			CurrentConfig.ProcessConfigFile(ContainerConfigPath, ContainerMattermostDir)
+		}
+	} else {
+		// Copy all log files from the Mattermost directory to the temp directory
+		LogMessage(infoLevel, "Copying Mattermost log files")
+		err = CopyLogFiles(CurrentConfig.LogDirectory, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to copy Mattermost log files. Error: "+err.Error())
+		}
 
-	// Gather details of top running processes
-	LogMessage(infoLevel, "Gathering details of running processes")
-	err = GetTopProcesses(tempDirectory)
-	if err != nil {
-		LogMessage(warningLevel, "Failed to get top processes. Error: "+err.Error())
+		// Copy the config file to the temp directory
+		LogMessage(infoLevel, "Copying Mattermost config file")
+		err = CopyConfigFile(ConfigFilePath, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to copy the Mattermost config file. Error: "+err.Error())
+		}
+
+		// Work out what is managing Mattermost, so that we collect the right service information
+		ServiceManager = detectServiceManager(ServiceName)
+		DebugPrint("Service manager: " + ServiceManager)
+
+		if ServiceManager == serviceManagerSystemd {
+			// Gathering information from system services
+			LogMessage(infoLevel, "Gathering service level information")
+			if !GatherServiceMessages(ServiceName, tempDirectory) {
+				LogMessage(warningLevel, "Not all service information was gathered")
+			}
+
+			// Collect the journal for Mattermost and related services
+			LogMessage(infoLevel, "Collecting journal messages")
+			JournalOptions := journalOptions{Since: JournalSince, Until: JournalUntil, JSON: JournalJSONFlag}
+			if !CollectJournal(ServiceName, JournalOptions, tempDirectory) {
+				LogMessage(warningLevel, "Not all journal messages were collected")
+			}
+
+			// Capture the systemd unit definition, drop-ins and environment
+			LogMessage(infoLevel, "Capturing systemd unit definition")
+			if !CaptureSystemdUnit(ServiceName, tempDirectory) {
+				LogMessage(warningLevel, "Not all systemd unit information was captured")
+			}
+
+			// Work out whether Mattermost is crash-looping, and why
+			LogMessage(infoLevel, "Analysing service restart history")
+			err = AnalyseRestartHistory(ServiceName, JournalOptions, tempDirectory)
+			if err != nil {
+				LogMessage(warningLevel, "Failed to analyse service restart history.  Error: "+err.Error())
+			}
+		} else {
+			// Gathering information from a non-systemd service manager
+			LogMessage(infoLevel, "Gathering "+ServiceManager+" service information")
+			if !GatherServiceManagerInformation(ServiceManager, ServiceName, tempDirectory) {
+				LogMessage(warningLevel, "Not all service information was gathered")
+			}
+		}
+
+		// Record the running Mattermost processes, however they were started
+		LogMessage(infoLevel, "Recording running Mattermost processes")
+		err = RecordMattermostProcesses(MattermostDir, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to record Mattermost processes.  Error: "+err.Error())
+		}
+
+		// Identify the installed Mattermost version
+		LogMessage(infoLevel, "Identifying the installed Mattermost version")
+		var InstalledVersion string
+		InstalledVersion, err = CollectMattermostVersion(CurrentConfig, MattermostDir, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to identify the Mattermost version.  Error: "+err.Error())
+		}
+
+		// Look for signs of a broken or partial upgrade
+		LogMessage(infoLevel, "Checking installation integrity")
+		err = CheckInstallIntegrity(MattermostDir, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to check installation integrity.  Error: "+err.Error())
+		}
+
+		// List the installed plugins, and check them against the config and the installed version
+		LogMessage(infoLevel, "Collecting plugin inventory")
+		err = CollectPluginInventory(CurrentConfig, MattermostDir, InstalledVersion, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to collect plugin inventory.  Error: "+err.Error())
+		}
+
+		// Check that the service user can use all of Mattermost's files
+		LogMessage(infoLevel, "Auditing file ownership and permissions")
+		err = AuditPermissions(CurrentConfig, MattermostDir, ConfigFilePath, ServiceManager, ServiceName, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to audit file ownership and permissions.  Error: "+err.Error())
+		}
 	}
 
-	// Get port listening info from netstat/ss
-	LogMessage(infoLevel, "Checking port listening status")
-	err = CheckListeningPort(CurrentConfig.ListenPort, tempDirectory)
-	if err != nil {
-		LogMessage(warningLevel, "Failed to locate listening port information.  Error: "+err.Error())
+	// Learn the customer's domains, so that hostnames can be masked wherever they appear in the collected files
+	if EnableObfuscation {
+		LearnObfuscatedDomains(CurrentConfig, ObfuscateDomains)
 	}
 
-	// Copy OS information files to target directory
-	LogMessage(infoLevel, "Copying key OS information files")
-	if !CopyOSInfoFiles(tempDirectory) {
-		LogMessage(warningLevel, "Some OS info files may be missing!")
+	// The remaining collectors look at the local host, which isn't where Mattermost is running when we're collecting
+	// from Kubernetes
+	if !KubernetesFlag {
+		// Take a snapshot of the running processes
+		LogMessage(infoLevel, "Gathering details of running processes")
+		err = CollectProcessSnapshot(tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to take process snapshot. Error: "+err.Error())
+		}
+
+		// Examine the running Mattermost process in detail
+		LogMessage(infoLevel, "Analysing the Mattermost process")
+		err = AnalyseMattermostProcess(MattermostDir, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to analyse the Mattermost process.  Error: "+err.Error())
+		}
+
+		// Fetch goroutine dumps and profiles from the running server
+		LogMessage(infoLevel, "Collecting Go runtime profiles")
+		err = CollectRuntimeProfiles(CurrentConfig, CPUProfileSeconds, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to collect Go runtime profiles.  Error: "+err.Error())
+		}
+
+		// Sample the Prometheus metrics of the running server
+		if MetricsSamples > 0 {
+			LogMessage(infoLevel, "Collecting metrics snapshot")
+			err = CollectMetricsSnapshot(CurrentConfig, MetricsSamples, MetricsInterval, tempDirectory)
+			if err != nil {
+				LogMessage(warningLevel, "Failed to collect metrics snapshot.  Error: "+err.Error())
+			}
+		}
+
+		// Query the running server's API, if requested
+		if APIProbeFlag {
+			LogMessage(infoLevel, "Querying the server API")
+			err = ProbeServerAPI(CurrentConfig, APIToken, tempDirectory)
+			if err != nil {
+				LogMessage(warningLevel, "Failed to query the server API.  Error: "+err.Error())
+			}
+
+			// The schema version is only available from the server's own support packet
+			if HostInstall && APIToken != "" {
+				err = RecordDatabaseSchemaVersion(tempDirectory)
+				if err != nil {
+					LogMessage(warningLevel, "Failed to record the database schema version.  Error: "+err.Error())
+				}
+			}
+		}
+
+		// Get port listening info from netstat/ss
+		LogMessage(infoLevel, "Checking port listening status")
+		err = CheckListeningPort(CurrentConfig.ListenPort, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to locate listening port information.  Error: "+err.Error())
+		}
+
+		// Check the TLS certificates and the TLS listener (if any).  Under Docker, the certificate files are inside the
+		// container, so this only applies to host installs.
+		if HostInstall {
+			LogMessage(infoLevel, "Checking TLS configuration")
+			err = CheckTLSConfiguration(CurrentConfig, MattermostDir, tempDirectory)
+			if err != nil {
+				LogMessage(warningLevel, "Failed to check TLS configuration.  Error: "+err.Error())
+			}
+		}
+
+		// Record the state of SELinux and AppArmor, which can silently block Mattermost
+		LogMessage(infoLevel, "Collecting SELinux and AppArmor status")
+		err = CollectSecurityModules(CurrentConfig, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to collect SELinux and AppArmor status.  Error: "+err.Error())
+		}
+
+		// Capture and analyse any reverse proxy sitting in front of Mattermost
+		LogMessage(infoLevel, "Collecting reverse proxy configuration")
+		err = CollectReverseProxyConfig(CurrentConfig, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to collect reverse proxy configuration.  Error: "+err.Error())
+		}
+
+		// Copy OS information files to target directory
+		LogMessage(infoLevel, "Copying key OS information files")
+		if !CopyOSInfoFiles(tempDirectory) {
+			LogMessage(warningLevel, "Some OS info files may be missing!")
+		}
+
+		// Record the kernel, sysctl and resource limit settings
+		LogMessage(infoLevel, "Collecting system facts")
+		err = CollectSystemFacts(ServiceManager, ServiceName, MattermostDir, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to collect system facts.  Error: "+err.Error())
+		}
+
+		// Record the resource limits imposed by Mattermost's cgroup
+		LogMessage(infoLevel, "Collecting cgroup limits")
+		err = CollectCgroupLimits(ServiceManager, ServiceName, MattermostDir, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to collect cgroup limits.  Error: "+err.Error())
+		}
+
+		// Get the disk free space
+		LogMessage(infoLevel, "Retrieving disk space information")
+		err = GetDiskSpace(CurrentConfig, MattermostDir, tempDirectory)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to retrieve disk space utilisation")
+		}
 	}
 
-	// Get the disk free space
-	LogMessage(infoLevel, "Retrieving disk space information")
-	err = GetDiskSpace(tempDirectory)
+	// Write the summary of findings from all collectors.  This is done before obfuscation, so the summary is obfuscated too.
+	LogMessage(infoLevel, "Writing summary report")
+	err = WriteSummary(tempDirectory)
 	if err != nil {
-		LogMessage(warningLevel, "Failed to retrieve disk space utilisation")
+		LogMessage(warningLevel, "Failed to write summary report.  Error: "+err.Error())
 	}
 
 	// Obfuscate sensitive data in all collected files
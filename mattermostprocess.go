@@ -0,0 +1,351 @@
+// Package main contains the Mattermost process deep-dive, which examines the running server process in detail
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// processArea is the area name used for summary findings relating to the running Mattermost process
+const processArea = "Mattermost Process"
+
+const (
+	// fileLimitWarningPercent is the proportion of the open files limit in use at which we start to warn
+	fileLimitWarningPercent = 80
+	// maxOpenFileDirectories is the number of directories listed when summarising where open files are
+	maxOpenFileDirectories = 10
+)
+
+// tcpStates maps the hex socket states in /proc/net/tcp to their names
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// tcpSocket is a TCP socket from /proc/net/tcp or /proc/net/tcp6
+type tcpSocket struct {
+	LocalPort  int
+	RemotePort int
+	State      string
+}
+
+// readTCPSockets parses the TCP socket tables in the network namespace of the given process, returning the sockets
+// keyed by inode so that they can be matched against the process's file descriptors.
+func readTCPSockets(pid int) map[string]tcpSocket {
+	sockets := make(map[string]tcpSocket)
+
+	for _, table := range []string{"tcp", "tcp6"} {
+		file, err := os.Open("/proc/" + strconv.Itoa(pid) + "/net/" + table)
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Scan() // Skip the header
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			sockets[fields[9]] = tcpSocket{
+				LocalPort:  parseHexPort(fields[1]),
+				RemotePort: parseHexPort(fields[2]),
+				State:      tcpStates[fields[3]],
+			}
+		}
+		file.Close()
+	}
+
+	return sockets
+}
+
+// parseHexPort extracts the port from an address in /proc/net/tcp, e.g. "0100007F:1F91" => 8081
+func parseHexPort(address string) int {
+	index := strings.LastIndex(address, ":")
+	if index == -1 {
+		return 0
+	}
+	port, _ := strconv.ParseInt(address[index+1:], 16, 32)
+	return int(port)
+}
+
+// parseOpenFilesLimit extracts the soft and hard "Max open files" limits from /proc/<pid>/limits.  A value of -1
+// means unlimited.
+func parseOpenFilesLimit(limits string) (int64, int64, error) {
+	for _, line := range strings.Split(limits, "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) < 2 {
+			break
+		}
+		parse := func(value string) int64 {
+			if value == "unlimited" {
+				return -1
+			}
+			limit, _ := strconv.ParseInt(value, 10, 64)
+			return limit
+		}
+		return parse(fields[0]), parse(fields[1]), nil
+	}
+	return 0, 0, errors.New("Max open files not found in limits")
+}
+
+// writeSortedCounts writes a map of counts, largest first, with an optional limit on the number of entries
+func writeSortedCounts(w io.Writer, counts map[string]int, limit int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %-40s %d\n", key, counts[key])
+	}
+}
+
+// writeFileDescriptorSummary classifies the open file descriptors of a process by type, summarises where its open
+// files are and the states of its TCP connections.
+func writeFileDescriptorSummary(w io.Writer, pid int) error {
+	fdDir := "/proc/" + strconv.Itoa(pid) + "/fd"
+	entries, err := os.ReadDir(fdDir)
+	if err != nil {
+		return err
+	}
+
+	sockets := readTCPSockets(pid)
+	types := make(map[string]int)
+	directories := make(map[string]int)
+	states := make(map[string]int)
+	remotePorts := make(map[string]int)
+	listening := make(map[string]int)
+
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(fdDir, entry.Name()))
+		if err != nil {
+			// The descriptor was closed while we were looking
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(target, "socket:["):
+			inode := strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")
+			socket, ok := sockets[inode]
+			if !ok {
+				types["socket (unix/other)"]++
+				continue
+			}
+			types["socket (tcp)"]++
+			states[socket.State]++
+			if socket.State == "LISTEN" {
+				listening[strconv.Itoa(socket.LocalPort)]++
+			} else {
+				remotePorts[strconv.Itoa(socket.RemotePort)]++
+			}
+		case strings.HasPrefix(target, "pipe:["):
+			types["pipe"]++
+		case strings.HasPrefix(target, "anon_inode:"):
+			types[strings.NewReplacer("[", "", "]", "").Replace(target)]++
+		case strings.HasPrefix(target, "/dev/"):
+			types["device"]++
+		default:
+			types["file"]++
+			directories[filepath.Dir(strings.TrimSuffix(target, " (deleted)"))]++
+		}
+	}
+
+	fmt.Fprintf(w, "Open File Descriptors: %d\n", len(entries))
+	writeSortedCounts(w, types, 0)
+
+	fmt.Fprintf(w, "\nOpen Files by Directory (top %d)\n", maxOpenFileDirectories)
+	writeSortedCounts(w, directories, maxOpenFileDirectories)
+
+	fmt.Fprintf(w, "\nTCP Socket States\n")
+	writeSortedCounts(w, states, 0)
+
+	fmt.Fprintf(w, "\nListening Ports\n")
+	writeSortedCounts(w, listening, 0)
+
+	fmt.Fprintf(w, "\nConnections by Remote Port (e.g. 5432 = PostgreSQL, 3306 = MySQL)\n")
+	writeSortedCounts(w, remotePorts, 0)
+
+	if states["CLOSE_WAIT"] > 100 {
+		AddSummaryFinding(warningLevel, processArea, fmt.Sprintf("Mattermost (PID %d) has %d connections in CLOSE_WAIT, which suggests connections aren't being closed", pid, states["CLOSE_WAIT"]))
+	}
+
+	return nil
+}
+
+// writeThreadStates counts the threads of a process by state (e.g. running, sleeping, uninterruptible)
+func writeThreadStates(w io.Writer, pid int) {
+	entries, err := os.ReadDir("/proc/" + strconv.Itoa(pid) + "/task")
+	if err != nil {
+		fmt.Fprintf(w, "Unable to read threads: %s\n", err.Error())
+		return
+	}
+
+	states := make(map[string]int)
+	for _, entry := range entries {
+		content, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/task/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		line := string(content)
+		if end := strings.LastIndex(line, ")"); end != -1 {
+			if fields := strings.Fields(line[end+1:]); len(fields) > 0 {
+				states[fields[0]]++
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "Threads: %d\n", len(entries))
+	writeSortedCounts(w, states, 0)
+}
+
+// writeEnvironment lists the process's environment variables.  The values frequently contain secrets (e.g.
+// MM_SQLSETTINGS_DATASOURCE), so the values of secret-looking variables, and any database URLs, are masked here, even
+// if obfuscation of the rest of the packet has been disabled.
+func writeEnvironment(w io.Writer, pid int) {
+	content, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ")
+	if err != nil {
+		fmt.Fprintf(w, "Unable to read environment: %s\n", err.Error())
+		return
+	}
+
+	var variables []string
+	for _, variable := range strings.Split(string(content), "\x00") {
+		name, value, found := strings.Cut(variable, "=")
+		if !found {
+			continue
+		}
+		if value != "" && secretVariableNamePattern.MatchString(name) {
+			value = obfuscateSecretValue(name, value)
+		}
+		value = databaseURLPattern.ReplaceAllStringFunc(value, obfuscateDatabaseDSN)
+		variables = append(variables, name+"="+value)
+	}
+	sort.Strings(variables)
+
+	for _, variable := range variables {
+		fmt.Fprintf(w, "  %s\n", variable)
+	}
+}
+
+// writeProcFile copies a file from /proc/<pid>/ into the report under a heading
+func writeProcFile(w io.Writer, pid int, name string, heading string) string {
+	fmt.Fprintf(w, "\n== %s (/proc/%d/%s) ==\n", heading, pid, name)
+	content, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/" + name)
+	if err != nil {
+		fmt.Fprintf(w, "Unable to read: %s\n", err.Error())
+		return ""
+	}
+	fmt.Fprintf(w, "%s", content)
+	return string(content)
+}
+
+// checkOpenFilesLimit compares the number of open files with the process's limit, and with the limit we recommend
+func checkOpenFilesLimit(w io.Writer, pid int, limits string, openFiles int) {
+	soft, hard, err := parseOpenFilesLimit(limits)
+	if err != nil {
+		fmt.Fprintf(w, "Unable to determine open files limit: %s\n", err.Error())
+		return
+	}
+
+	if soft < 0 {
+		fmt.Fprintf(w, "Open files: %d of unlimited\n", openFiles)
+		return
+	}
+	percent := float64(openFiles) / float64(soft) * 100
+	fmt.Fprintf(w, "Open files: %d of %d (%.1f%%), hard limit %d\n", openFiles, soft, percent, hard)
+
+	if percent >= fileLimitWarningPercent {
+		AddSummaryFinding(errorLevel, processArea, fmt.Sprintf("Mattermost (PID %d) is using %.0f%% of its open files limit (%d of %d) - expect 'too many open files' errors", pid, percent, openFiles, soft))
+	}
+	if soft < recommendedLimitNOFILE {
+		AddSummaryFinding(warningLevel, processArea, fmt.Sprintf("Mattermost (PID %d) is running with an open files limit of %d - at least %d is recommended", pid, soft, recommendedLimitNOFILE))
+	}
+}
+
+// writeMattermostProcessReport writes the deep-dive for a single Mattermost process
+func writeMattermostProcessReport(w io.Writer, pid int) {
+	fmt.Fprintf(w, "########## Mattermost process %d ##########\n", pid)
+	fmt.Fprintf(w, "Executable:   %s\n", readProcessExe(pid))
+	fmt.Fprintf(w, "Command Line: %s\n\n", readProcessCmdline(pid))
+
+	fmt.Fprintf(w, "== Open Files Limit ==\n")
+	limits, _ := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/limits")
+	openFiles, _ := countOpenFiles(pid)
+	checkOpenFilesLimit(w, pid, string(limits), openFiles)
+
+	fmt.Fprintf(w, "\n== File Descriptors and Sockets ==\n")
+	if err := writeFileDescriptorSummary(w, pid); err != nil {
+		fmt.Fprintf(w, "Unable to read file descriptors: %s\n", err.Error())
+	}
+
+	fmt.Fprintf(w, "\n== Threads ==\n")
+	writeThreadStates(w, pid)
+
+	fmt.Fprintf(w, "\n== Environment (secrets masked) ==\n")
+	writeEnvironment(w, pid)
+
+	writeProcFile(w, pid, "limits", "Limits")
+	writeProcFile(w, pid, "status", "Status")
+	writeProcFile(w, pid, "cgroup", "Control Groups")
+	writeProcFile(w, pid, "smaps_rollup", "Memory Map Summary")
+	fmt.Fprintf(w, "\n")
+}
+
+// AnalyseMattermostProcess locates the running Mattermost server process(es) and captures the details needed to
+// troubleshoot a server that is running but misbehaving: resource limits, status, open file descriptors by type, TCP
+// socket states, thread states, control group membership, environment variables (with secrets masked) and a
+// summary of its memory maps.  The number of open files is compared with the process's LimitNOFILE.
+// The Mattermost directory and the temp directory are passed as parameters, and the function returns an error object
+// (nil on success).
+// The report is written to mattermost-process.txt in the temp directory.
+func AnalyseMattermostProcess(mmDir string, targetDir string) error {
+	DebugPrint("Analysing Mattermost process - writing to: " + targetDir)
+
+	pids := findMattermostProcesses(mmDir)
+	if len(pids) == 0 {
+		DebugPrint("No running Mattermost process to analyse")
+		return nil
+	}
+
+	file, err := os.Create(targetDir + "/mattermost-process.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for Mattermost process analysis in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	for _, pid := range pids {
+		writeMattermostProcessReport(file, pid)
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+// Package main contains the Prometheus metrics collector, which samples the metrics of a running Mattermost server
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsArea is the area name used for summary findings relating to the Prometheus metrics
+const metricsArea = "Metrics"
+
+const (
+	// defaultMetricsSamples and defaultMetricsInterval control how many times we scrape the metrics endpoint, and how
+	// many seconds apart.  Several samples are needed to turn counters into rates.
+	defaultMetricsSamples  = 3
+	defaultMetricsInterval = 10
+	// metricsRequestTimeout limits how long we'll wait for a single scrape
+	metricsRequestTimeout = 30 * time.Second
+	// defaultSQLMaxOpenConns is Mattermost's default for SqlSettings.MaxOpenConns
+	defaultSQLMaxOpenConns = 300
+	// httpErrorRateWarning is the proportion of HTTP requests failing, above which we report a warning
+	httpErrorRateWarning = 0.05
+	// connectionPoolWarning is the proportion of SqlSettings.MaxOpenConns in use, above which we report a warning
+	connectionPoolWarning = 0.8
+)
+
+// The Mattermost metrics used to derive the rates in the summary.  The database connection metrics are gauges of the
+// connections currently open, despite their names.
+const (
+	httpRequestsMetric          = "mattermost_http_requests_total"
+	httpErrorsMetric            = "mattermost_http_errors_total"
+	dbMasterConnectionsMetric   = "mattermost_db_master_connections_total"
+	dbReplicaConnectionsMetric  = "mattermost_db_read_replica_connections_total"
+	websocketConnectionsMetric  = "mattermost_http_websockets_total"
+	clusterHealthScoreMetric    = "mattermost_cluster_cluster_health_score"
+	goroutinesMetric            = "go_goroutines"
+	processOpenFileHandleMetric = "process_open_fds"
+)
+
+// metricsSample is a single scrape of the metrics endpoint.  Values holds the total of each metric across all of its
+// label combinations, which is all we need for the derived rates.
+type metricsSample struct {
+	Time   time.Time
+	Values map[string]float64
+}
+
+// parseMetricsExposition parses the Prometheus text exposition format, summing each metric across its labels.  Label
+// values may contain spaces, so the value is taken from after the closing brace of the labels.
+func parseMetricsExposition(reader io.Reader) (map[string]float64, error) {
+	values := make(map[string]float64)
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, rest := line, ""
+		if open := strings.Index(line, "{"); open != -1 {
+			end := strings.LastIndex(line, "}")
+			if end < open {
+				continue
+			}
+			name, rest = line[:open], line[end+1:]
+		} else if space := strings.IndexAny(line, " \t"); space != -1 {
+			name, rest = line[:space], line[space:]
+		}
+
+		// The value may be followed by an optional timestamp
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		values[name] += value
+	}
+	return values, scanner.Err()
+}
+
+// scrapeMetrics fetches the metrics endpoint once, saving the raw exposition text to the given file and returning the
+// parsed sample
+func scrapeMetrics(client *http.Client, metricsURL string, outputFile string) (*metricsSample, error) {
+	DebugPrint("Scraping metrics: " + metricsURL)
+
+	sample := &metricsSample{Time: time.Now()}
+	response, err := client.Get(metricsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", metricsURL, response.Status)
+	}
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sample.Values, err = parseMetricsExposition(io.TeeReader(response.Body, file))
+	if err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// maximumMetric returns the highest value of a gauge across all samples, and whether the metric was present at all
+func maximumMetric(samples []*metricsSample, name string) (float64, bool) {
+	maximum, found := 0.0, false
+	for _, sample := range samples {
+		if value, ok := sample.Values[name]; ok && (!found || value > maximum) {
+			maximum, found = value, true
+		}
+	}
+	return maximum, found
+}
+
+// writeDerivedMetrics works out rates and utilisation from the samples, writing them to the given file and reporting
+// anything of concern in the summary
+func writeDerivedMetrics(samples []*metricsSample, maxOpenConns int, outputFile string) error {
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	first, last := samples[0], samples[len(samples)-1]
+	fmt.Fprintf(file, "Samples: %d, from %s to %s\n\n", len(samples), first.Time.Format(time.RFC3339), last.Time.Format(time.RFC3339))
+
+	// HTTP error rate.  With several samples we use the change over the sampling window, which reflects what's
+	// happening now; with only one we fall back to the totals since the server started.
+	requests, httpErrors := last.Values[httpRequestsMetric], last.Values[httpErrorsMetric]
+	window := "since the server started"
+	if seconds := last.Time.Sub(first.Time).Seconds(); seconds > 0 && requests >= first.Values[httpRequestsMetric] {
+		requests -= first.Values[httpRequestsMetric]
+		httpErrors -= first.Values[httpErrorsMetric]
+		window = "during sampling"
+		fmt.Fprintf(file, "HTTP requests:           %.1f/s\n", requests/seconds)
+		fmt.Fprintf(file, "HTTP errors:             %.1f/s\n", httpErrors/seconds)
+	}
+	if requests > 0 {
+		errorRate := httpErrors / requests
+		fmt.Fprintf(file, "HTTP error rate:         %.2f%% (%s)\n", errorRate*100, window)
+		if errorRate > httpErrorRateWarning {
+			AddSummaryFinding(warningLevel, metricsArea, fmt.Sprintf("%.1f%% of HTTP requests failed %s - see metrics/derived.txt", errorRate*100, window))
+		}
+	} else {
+		fmt.Fprintf(file, "HTTP error rate:         no requests %s\n", window)
+	}
+
+	// Database connection pool saturation
+	if connections, ok := maximumMetric(samples, dbMasterConnectionsMetric); ok {
+		saturation := connections / float64(maxOpenConns)
+		fmt.Fprintf(file, "DB master connections:   %.0f of %d (%.0f%%, peak)\n", connections, maxOpenConns, saturation*100)
+		if saturation >= connectionPoolWarning {
+			AddSummaryFinding(warningLevel, metricsArea, fmt.Sprintf("The database connection pool is %.0f%% used (%.0f of SqlSettings.MaxOpenConns %d)", saturation*100, connections, maxOpenConns))
+		}
+	}
+	if connections, ok := maximumMetric(samples, dbReplicaConnectionsMetric); ok {
+		fmt.Fprintf(file, "DB replica connections:  %.0f (peak)\n", connections)
+	}
+
+	// Websocket connections
+	if websockets, ok := last.Values[websocketConnectionsMetric]; ok {
+		fmt.Fprintf(file, "Websocket connections:   %.0f\n", websockets)
+		AddSummaryFinding(infoLevel, metricsArea, fmt.Sprintf("Mattermost has %.0f websocket connections", websockets))
+	}
+
+	// Cluster health.  The health score comes from the cluster's gossip protocol, where 0 is healthy and higher scores
+	// mean the node is struggling to keep up with the rest of the cluster.
+	if score, ok := maximumMetric(samples, clusterHealthScoreMetric); ok {
+		fmt.Fprintf(file, "Cluster health score:    %.0f (peak, 0 is healthy)\n", score)
+		if score > 0 {
+			AddSummaryFinding(warningLevel, metricsArea, fmt.Sprintf("The cluster health score reached %.0f during sampling (0 is healthy)", score))
+		}
+	}
+
+	// Runtime
+	if goroutines, ok := last.Values[goroutinesMetric]; ok {
+		fmt.Fprintf(file, "Goroutines:              %.0f\n", goroutines)
+	}
+	if openFiles, ok := last.Values[processOpenFileHandleMetric]; ok {
+		fmt.Fprintf(file, "Open file descriptors:   %.0f\n", openFiles)
+	}
+
+	return nil
+}
+
+// CollectMetricsSnapshot scrapes the Prometheus metrics of a running Mattermost server, served on the metrics listen
+// address (MetricsSettings), several times over an interval.  The raw exposition text of each scrape is kept, and
+// rates are derived from the samples: the HTTP error rate, database connection pool saturation (against
+// SqlSettings.MaxOpenConns), websocket connections and the cluster health score.  Anything of concern is added to the
+// summary report.  The parsed config, the number of samples, the interval between them (in seconds) and the temp
+// directory are passed as parameters, and the function returns an error object (nil on success).
+// The scrapes are written to metrics/sample-<n>.txt, and the derived rates to metrics/derived.txt, in the temp
+// directory.
+func CollectMetricsSnapshot(config *mmConfig, samples int, interval int, targetDir string) error {
+	DebugPrint("Collecting metrics snapshot - writing to: " + targetDir)
+
+	if !config.MetricsEnabled {
+		LogMessage(infoLevel, "Metrics are disabled, so no metrics snapshot can be collected")
+		AddSummaryFinding(infoLevel, metricsArea, "MetricsSettings.Enable is false, so no metrics were collected")
+		return nil
+	}
+	if samples < 1 {
+		return nil
+	}
+
+	metricsDir := targetDir + "/metrics"
+	if err := os.MkdirAll(metricsDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+metricsDir)
+		return errors.New(err.Error())
+	}
+
+	metricsURL := metricsBaseURL(config.MetricsListenAddress) + "/metrics"
+	client := &http.Client{Timeout: metricsRequestTimeout}
+
+	var collected []*metricsSample
+	for index := 1; index <= samples; index++ {
+		if index > 1 {
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+		outputFile := fmt.Sprintf("%s/sample-%d.txt", metricsDir, index)
+		sample, err := scrapeMetrics(client, metricsURL, outputFile)
+		if err != nil {
+			os.Remove(outputFile)
+			if index == 1 {
+				// If the first scrape fails, the server isn't responding, so don't wait for the others
+				AddSummaryFinding(warningLevel, metricsArea, "Unable to scrape metrics from "+metricsURL)
+				return errors.New(err.Error())
+			}
+			LogMessage(warningLevel, fmt.Sprintf("Failed to scrape metrics sample %d: %s", index, err.Error()))
+			continue
+		}
+		collected = append(collected, sample)
+	}
+
+	maxOpenConns := config.SQLMaxOpenConns
+	if maxOpenConns <= 0 {
+		maxOpenConns = defaultSQLMaxOpenConns
+	}
+	if err := writeDerivedMetrics(collected, maxOpenConns, metricsDir+"/derived.txt"); err != nil {
+		LogMessage(warningLevel, "Failed to write derived metrics: "+err.Error())
+		return errors.New(err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,342 @@
+// Package main contains the permission audit, which checks that the Mattermost service user can use its files
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// permissionsArea is the area name used for summary findings relating to the permission audit
+const permissionsArea = "Permissions"
+
+const (
+	// defaultFileDirectory is Mattermost's default for FileSettings.Directory, relative to the install directory
+	defaultFileDirectory = "data"
+	// maxAuditEntries limits how many files we examine in each audited tree.  The data directory in particular can
+	// hold millions of files.
+	maxAuditEntries = 50000
+	// maxPermissionProblems limits how many problem paths are listed
+	maxPermissionProblems = 1000
+)
+
+// serviceAccount identifies the user Mattermost runs as, and the groups that user belongs to
+type serviceAccount struct {
+	Name   string
+	UID    uint32
+	GID    uint32
+	Groups map[uint32]bool
+	Source string
+}
+
+// auditTarget is a path that the service user needs to be able to write to.  Trees are audited recursively.
+type auditTarget struct {
+	Name string
+	Path string
+	Tree bool
+}
+
+// lookupServiceAccount resolves a username (or numeric ID) into the account's IDs and groups
+func lookupServiceAccount(name string, source string) (*serviceAccount, error) {
+	found, err := user.Lookup(name)
+	if err != nil {
+		if found, err = user.LookupId(name); err != nil {
+			return nil, err
+		}
+	}
+
+	uid, _ := strconv.ParseUint(found.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(found.Gid, 10, 32)
+	account := &serviceAccount{Name: found.Username, UID: uint32(uid), GID: uint32(gid), Groups: map[uint32]bool{uint32(gid): true}, Source: source}
+	if groupIDs, err := found.GroupIds(); err == nil {
+		for _, groupID := range groupIDs {
+			if id, err := strconv.ParseUint(groupID, 10, 32); err == nil {
+				account.Groups[uint32(id)] = true
+			}
+		}
+	}
+	return account, nil
+}
+
+// determineServiceAccount works out which user Mattermost runs as.  The systemd unit is authoritative (systemd runs
+// services as root if no User is set); otherwise we use the user of the running server, or failing that the owner of
+// the server binary.
+func determineServiceAccount(serviceManager string, serviceName string, mmDir string) (*serviceAccount, error) {
+	if serviceManager == serviceManagerSystemd {
+		if properties, err := getSystemdProperties(serviceName, "User"); err == nil {
+			if properties["User"] == "" {
+				return lookupServiceAccount("root", "systemd unit "+serviceName+" (no User set)")
+			}
+			return lookupServiceAccount(properties["User"], "systemd unit "+serviceName)
+		}
+	}
+
+	if pids := findMattermostProcesses(mmDir); len(pids) > 0 {
+		if uid, err := processUID(pids[0]); err == nil {
+			return lookupServiceAccount(uid, fmt.Sprintf("running process %d", pids[0]))
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(mmDir, "bin", "mattermost"))
+	if err != nil {
+		return nil, errors.New("unable to determine the service user")
+	}
+	uid, _, _ := fileOwnership(info)
+	return lookupServiceAccount(strconv.FormatUint(uint64(uid), 10), "owner of bin/mattermost")
+}
+
+// canAccess reports whether the account has the given permissions (4 = read, 2 = write, 1 = execute) on a file, based
+// on its owner, group and mode.  ACLs aren't taken into account - paths with ACLs are flagged separately.
+func (a *serviceAccount) canAccess(info fs.FileInfo, permission fs.FileMode) bool {
+	if a.UID == 0 {
+		return true
+	}
+	uid, gid, ok := fileOwnership(info)
+	if !ok {
+		return false
+	}
+	mode := info.Mode().Perm()
+	switch {
+	case uid == a.UID:
+		return mode&(permission<<6) == permission<<6
+	case a.Groups[gid]:
+		return mode&(permission<<3) == permission<<3
+	default:
+		return mode&permission == permission
+	}
+}
+
+// hasACL reports whether a file has a POSIX ACL, which may grant or deny access beyond what its mode shows
+func hasACL(path string) bool {
+	for _, attribute := range []string{"system.posix_acl_access", "system.posix_acl_default"} {
+		if size, err := syscall.Getxattr(path, attribute, nil); err == nil && size > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// selinuxContext returns the SELinux security context of a file, or an empty string if there isn't one
+func selinuxContext(path string) string {
+	buffer := make([]byte, 256)
+	size, err := syscall.Getxattr(path, "security.selinux", buffer)
+	if err != nil || size <= 0 {
+		return ""
+	}
+	return strings.TrimRight(string(buffer[:size]), "\x00")
+}
+
+// selinuxType extracts the type from an SELinux context, e.g. "httpd_sys_content_t" from
+// "system_u:object_r:httpd_sys_content_t:s0"
+func selinuxType(context string) string {
+	fields := strings.Split(context, ":")
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+// describeOwnership formats a file's owner, group and mode, e.g. "root:root -rw-------"
+func describeOwnership(info fs.FileInfo) string {
+	uid, gid, _ := fileOwnership(info)
+	group := strconv.FormatUint(uint64(gid), 10)
+	if found, err := user.LookupGroupId(group); err == nil {
+		group = found.Name
+	}
+	return lookupUsername(strconv.FormatUint(uint64(uid), 10)) + ":" + group + " " + info.Mode().String()
+}
+
+// auditPath checks a single path, returning a description of the problem if the account doesn't own it or can't use
+// it.  Directories need to be writable and searchable; files need to be readable and writable.
+func auditPath(account *serviceAccount, path string, info fs.FileInfo, rootType string) string {
+	var problems []string
+	// Root can use any file, so ownership only matters for other users
+	if uid, _, ok := fileOwnership(info); ok && account.UID != 0 && uid != account.UID {
+		problems = append(problems, "not owned by "+account.Name)
+	}
+
+	permission := fs.FileMode(4 | 2)
+	if info.IsDir() {
+		permission = 2 | 1
+	}
+	if !account.canAccess(info, permission) {
+		problems = append(problems, "not writable by "+account.Name)
+	}
+	if hasACL(path) {
+		problems = append(problems, "has an ACL")
+	}
+	if rootType != "" {
+		if fileType := selinuxType(selinuxContext(path)); fileType != "" && fileType != rootType {
+			problems = append(problems, "SELinux type "+fileType+" differs from "+rootType)
+		}
+	}
+
+	if len(problems) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s (%s)", path, strings.Join(problems, ", "), describeOwnership(info))
+}
+
+// auditTree checks every path in a tree (or a single path), up to maxAuditEntries, returning the problems found and
+// whether the tree was too large to check completely.  Directories listed in skip (audited as separate targets) are
+// not descended into.
+func auditTree(account *serviceAccount, target auditTarget, skip map[string]bool) ([]string, bool) {
+	rootType := selinuxType(selinuxContext(target.Path))
+	var problems []string
+	examined := 0
+	truncated := false
+
+	filepath.WalkDir(target.Path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", path, err.Error()))
+			return nil
+		}
+		if path != target.Path && (skip[path] || !target.Tree) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		examined++
+		if examined > maxAuditEntries {
+			truncated = true
+			return filepath.SkipAll
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if problem := auditPath(account, path, info, rootType); problem != "" {
+			problems = append(problems, problem)
+		}
+		return nil
+	})
+	return problems, truncated
+}
+
+// checkParentDirectories checks that the account can reach a path, i.e. that it can search every directory above it
+func checkParentDirectories(w io.Writer, account *serviceAccount, path string) {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(dir); err == nil && !account.canAccess(info, 1) {
+			fmt.Fprintf(w, "WARNING: %s can't search %s (%s), so can't reach %s\n", account.Name, dir, describeOwnership(info), path)
+			AddSummaryFinding(errorLevel, permissionsArea, account.Name+" can't search "+dir+", so can't reach "+path)
+		}
+		if dir == "/" || dir == "." {
+			return
+		}
+	}
+}
+
+// writeTargetDetails writes the ownership, ACL and SELinux context of an audit target
+func writeTargetDetails(w io.Writer, target auditTarget) {
+	info, err := os.Stat(target.Path)
+	if err != nil {
+		fmt.Fprintf(w, "%-14s %s: %s\n", target.Name, target.Path, err.Error())
+		return
+	}
+	fmt.Fprintf(w, "%-14s %s\n", target.Name, target.Path)
+	fmt.Fprintf(w, "  Ownership: %s\n", describeOwnership(info))
+	if context := selinuxContext(target.Path); context != "" {
+		fmt.Fprintf(w, "  SELinux:   %s\n", context)
+	}
+	if hasACL(target.Path) && commandExists("getfacl") {
+		output, _ := exec.Command("getfacl", "-p", target.Path).CombinedOutput()
+		fmt.Fprintf(w, "  ACL:\n")
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+}
+
+// AuditPermissions checks that the user Mattermost runs as can use all of its files - "permission denied" on the
+// config file, logs or data directory after someone has run the binary as root is a common self-inflicted outage.
+// The service user is taken from the systemd unit (or the running process, or the owner of the binary).  The install
+// directory, config file, log directory, FileSettings.Directory (for local file storage) and plugin directories are
+// audited for ownership, modes, POSIX ACLs and SELinux contexts, and every path that isn't owned by or writable by the
+// service user is listed.  Files whose SELinux type differs from the directory they're in (e.g. after being moved
+// from a home directory) are also listed.
+// The parsed config, the Mattermost directory, the config file path, the service manager, the service name and the
+// temp directory are passed as parameters, and the function returns an error object (nil on success).
+// The result is written to permissions.txt in the temp directory.
+func AuditPermissions(config *mmConfig, mmDir string, configPath string, serviceManager string, serviceName string, targetDir string) error {
+	DebugPrint("Auditing permissions - writing to: " + targetDir)
+
+	account, err := determineServiceAccount(serviceManager, serviceName, mmDir)
+	if err != nil {
+		LogMessage(warningLevel, "Unable to determine the Mattermost service user: "+err.Error())
+		return errors.New(err.Error())
+	}
+
+	file, err := os.Create(targetDir + "/permissions.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for permission audit in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "Permission Audit\n================\n")
+	fmt.Fprintf(file, "Service User: %s (uid %d, gid %d), from %s\n\n", account.Name, account.UID, account.GID, account.Source)
+
+	targets := []auditTarget{
+		{"Install", filepath.Clean(mmDir), true},
+		{"Config", filepath.Clean(configPath), false},
+		{"Logs", filepath.Clean(config.LogDirectory), true},
+		{"Plugins", resolveInstallPath(config.PluginDirectory, defaultPluginDirectory, mmDir), true},
+		{"Client Plugins", resolveInstallPath(config.PluginClientDir, defaultPluginClientDirectory, mmDir), true},
+	}
+	if config.FileDriverName == "" || config.FileDriverName == "local" {
+		targets = append(targets, auditTarget{"Data", resolveInstallPath(config.FileDirectory, defaultFileDirectory, mmDir), true})
+	}
+
+	// Each target is audited separately, so that the install directory audit doesn't descend into the others
+	skip := make(map[string]bool)
+	for _, target := range targets[1:] {
+		skip[target.Path] = true
+	}
+
+	for _, target := range targets {
+		writeTargetDetails(file, target)
+	}
+	checkParentDirectories(file, account, filepath.Clean(mmDir))
+
+	fmt.Fprintf(file, "\nPaths Not Owned or Writable by %s\n%s\n", account.Name, strings.Repeat("-", len("Paths Not Owned or Writable by ")+len(account.Name)))
+	total := 0
+	for _, target := range targets {
+		if _, err := os.Stat(target.Path); err != nil {
+			continue
+		}
+		problems, truncated := auditTree(account, target, skip)
+		if truncated {
+			fmt.Fprintf(file, "NOTE: %s has more than %d entries - only the first %d were checked\n", target.Path, maxAuditEntries, maxAuditEntries)
+		}
+		for _, problem := range problems {
+			if total < maxPermissionProblems {
+				fmt.Fprintf(file, "%s\n", problem)
+			}
+			total++
+		}
+		if len(problems) > 0 {
+			AddSummaryFinding(errorLevel, permissionsArea, fmt.Sprintf("%d paths under %s have ownership or permission problems for %s - see permissions.txt", len(problems), target.Path, account.Name))
+		}
+	}
+	if total > maxPermissionProblems {
+		fmt.Fprintf(file, "... and %d more\n", total-maxPermissionProblems)
+	}
+	if total == 0 {
+		fmt.Fprintf(file, "None\n")
+	}
+
+	return nil
+}
@@ -0,0 +1,294 @@
+// Package main contains the plugin inventory, which lists the installed plugins and their state
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pluginsArea is the area name used for summary findings relating to plugins
+const pluginsArea = "Plugins"
+
+const (
+	// defaultPluginDirectory and defaultPluginClientDirectory are Mattermost's defaults for PluginSettings.Directory
+	// and PluginSettings.ClientDirectory, relative to the install directory
+	defaultPluginDirectory       = "plugins"
+	defaultPluginClientDirectory = "client/plugins"
+	// maxPluginLogBytes limits how much of each plugin log file we copy
+	maxPluginLogBytes = 10 * 1024 * 1024
+)
+
+// pluginManifest holds the fields we use from a plugin's plugin.json
+type pluginManifest struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	Version          string `json:"version"`
+	MinServerVersion string `json:"min_server_version"`
+	Server           *struct {
+		Executable  string            `json:"executable"`
+		Executables map[string]string `json:"executables"`
+	} `json:"server"`
+	Webapp *struct {
+		BundlePath string `json:"bundle_path"`
+	} `json:"webapp"`
+}
+
+// pluginInfo is the inventory entry for a single installed plugin
+type pluginInfo struct {
+	ID               string   `json:"id"`
+	Name             string   `json:"name"`
+	Version          string   `json:"version"`
+	MinServerVersion string   `json:"min_server_version,omitempty"`
+	Directory        string   `json:"directory"`
+	Enabled          bool     `json:"enabled"`
+	InConfig         bool     `json:"in_config"`
+	Executable       string   `json:"executable,omitempty"`
+	WebappBundle     string   `json:"webapp_bundle,omitempty"`
+	ClientBundle     bool     `json:"client_bundle"`
+	Problems         []string `json:"problems,omitempty"`
+}
+
+// resolveInstallPath converts a directory from the config (e.g. PluginSettings.Directory), which may be relative to the
+// install directory, into an absolute path
+func resolveInstallPath(directory string, defaultDirectory string, mmDir string) string {
+	if directory == "" {
+		directory = defaultDirectory
+	}
+	if filepath.IsAbs(directory) {
+		return filepath.Clean(directory)
+	}
+	return filepath.Join(mmDir, directory)
+}
+
+// compareVersions compares two version numbers (e.g. "9.11.1") by their numeric components, ignoring any suffix such as
+// "-rc1".  It returns -1, 0 or 1, like strings.Compare.
+func compareVersions(a string, b string) int {
+	partsA := strings.Split(versionNumberPattern.FindString(strings.TrimPrefix(a, "v")), ".")
+	partsB := strings.Split(versionNumberPattern.FindString(strings.TrimPrefix(b, "v")), ".")
+	for index := 0; index < len(partsA) && index < len(partsB); index++ {
+		numberA, _ := strconv.Atoi(partsA[index])
+		numberB, _ := strconv.Atoi(partsB[index])
+		if numberA != numberB {
+			if numberA < numberB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// serverExecutable returns the path of the plugin's server executable for this platform, relative to the plugin
+// directory.  Plugins either list an executable per platform, or a single executable.
+func (m *pluginManifest) serverExecutable() string {
+	if m.Server == nil {
+		return ""
+	}
+	if executable, ok := m.Server.Executables[runtime.GOOS+"-"+runtime.GOARCH]; ok {
+		return executable
+	}
+	return m.Server.Executable
+}
+
+// inspectPlugin reads a plugin's manifest and checks that the files it refers to are present
+func inspectPlugin(pluginDir string, clientDir string, config *mmConfig, serverVersion string) (*pluginInfo, error) {
+	content, err := os.ReadFile(filepath.Join(pluginDir, "plugin.json"))
+	if err != nil {
+		if _, yamlErr := os.Stat(filepath.Join(pluginDir, "plugin.yaml")); yamlErr == nil {
+			return nil, errors.New("plugin.yaml manifests can't be read - only plugin.json is supported")
+		}
+		return nil, err
+	}
+
+	var manifest pluginManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, errors.New("invalid plugin.json: " + err.Error())
+	}
+
+	plugin := &pluginInfo{
+		ID:               manifest.ID,
+		Name:             manifest.Name,
+		Version:          manifest.Version,
+		MinServerVersion: manifest.MinServerVersion,
+		Directory:        pluginDir,
+		Executable:       manifest.serverExecutable(),
+	}
+	plugin.Enabled, plugin.InConfig = config.PluginStates[manifest.ID]
+	if manifest.Webapp != nil {
+		plugin.WebappBundle = manifest.Webapp.BundlePath
+	}
+
+	if manifest.ID == "" {
+		plugin.Problems = append(plugin.Problems, "plugin.json has no id")
+	}
+	if plugin.Executable != "" {
+		info, err := os.Stat(filepath.Join(pluginDir, plugin.Executable))
+		if err != nil {
+			plugin.Problems = append(plugin.Problems, "server executable "+plugin.Executable+" is missing")
+		} else if info.Mode()&0111 == 0 {
+			plugin.Problems = append(plugin.Problems, "server executable "+plugin.Executable+" isn't executable")
+		}
+	} else if manifest.Server != nil {
+		plugin.Problems = append(plugin.Problems, "no server executable for "+runtime.GOOS+"-"+runtime.GOARCH)
+	}
+	if plugin.WebappBundle != "" {
+		if _, err := os.Stat(filepath.Join(pluginDir, plugin.WebappBundle)); err != nil {
+			plugin.Problems = append(plugin.Problems, "webapp bundle "+plugin.WebappBundle+" is missing")
+		}
+		// The server copies the webapp bundle into the client directory when the plugin is enabled
+		_, err := os.Stat(filepath.Join(clientDir, manifest.ID))
+		plugin.ClientBundle = err == nil
+		if plugin.Enabled && !plugin.ClientBundle {
+			plugin.Problems = append(plugin.Problems, "webapp bundle hasn't been deployed to the client directory")
+		}
+	}
+	if serverVersion != "" && manifest.MinServerVersion != "" && compareVersions(manifest.MinServerVersion, serverVersion) > 0 {
+		plugin.Problems = append(plugin.Problems, "requires server version "+manifest.MinServerVersion+" or later, but "+serverVersion+" is installed")
+	}
+
+	return plugin, nil
+}
+
+// copyPluginLogs copies any log files a plugin has written into its own directory, limiting the size of each
+func copyPluginLogs(plugin *pluginInfo, targetDir string) {
+	filepath.WalkDir(plugin.Directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".log") {
+			return nil
+		}
+		relative, _ := filepath.Rel(plugin.Directory, path)
+		destination := filepath.Join(targetDir, "logs", filepath.Base(plugin.Directory), relative)
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return nil
+		}
+		if err := tailFileToFile(path, destination, maxPluginLogBytes); err != nil {
+			LogMessage(warningLevel, "Failed to copy plugin log "+path+": "+err.Error())
+		}
+		return nil
+	})
+}
+
+// writePluginInventory writes the human-readable inventory of installed plugins
+func writePluginInventory(file io.Writer, config *mmConfig, serverDir string, clientDir string, plugins []*pluginInfo) {
+	fmt.Fprintf(file, "Plugin Inventory\n================\n")
+	fmt.Fprintf(file, "Plugins Enabled:  %t\n", config.PluginsEnabled)
+	fmt.Fprintf(file, "Directory:        %s\n", serverDir)
+	fmt.Fprintf(file, "Client Directory: %s\n\n", clientDir)
+
+	fmt.Fprintf(file, "%-40s %-12s %-12s %-9s %s\n", "ID", "VERSION", "MIN SERVER", "ENABLED", "PROBLEMS")
+	for _, plugin := range plugins {
+		enabled := strconv.FormatBool(plugin.Enabled)
+		if !plugin.InConfig {
+			enabled = "not set"
+		}
+		problems := strings.Join(plugin.Problems, "; ")
+		if problems == "" {
+			problems = "-"
+		}
+		fmt.Fprintf(file, "%-40s %-12s %-12s %-9s %s\n", plugin.ID, plugin.Version, plugin.MinServerVersion, enabled, problems)
+	}
+}
+
+// CollectPluginInventory lists the plugins installed in PluginSettings.Directory, as plugins are a major cause of
+// startup crashes.  Each plugin's plugin.json manifest is read for its ID, version, minimum server version and
+// executables, and the files it refers to are checked.  The enablement of each plugin comes from
+// PluginSettings.PluginStates in the config, and any plugin requiring a newer server than the one installed is
+// reported.  PluginSettings.ClientDirectory is checked for the webapp bundles of enabled plugins, and any log files
+// plugins have written into their own directories are copied.
+// The parsed config, the Mattermost directory, the installed server version (which may be empty if unknown) and the
+// temp directory are passed as parameters, and the function returns an error object (nil on success).
+// The inventory is written to plugins/plugins.txt and plugins/plugins.json, with plugin logs in plugins/logs/<plugin>,
+// in the temp directory.
+func CollectPluginInventory(config *mmConfig, mmDir string, serverVersion string, targetDir string) error {
+	DebugPrint("Collecting plugin inventory - writing to: " + targetDir)
+
+	serverDir := resolveInstallPath(config.PluginDirectory, defaultPluginDirectory, mmDir)
+	clientDir := resolveInstallPath(config.PluginClientDir, defaultPluginClientDirectory, mmDir)
+
+	if !config.PluginsEnabled {
+		AddSummaryFinding(infoLevel, pluginsArea, "Plugins are disabled (PluginSettings.Enable is false)")
+	}
+
+	entries, err := os.ReadDir(serverDir)
+	if err != nil {
+		LogMessage(warningLevel, "Unable to read plugin directory: "+serverDir)
+		return errors.New(err.Error())
+	}
+
+	pluginsDir := targetDir + "/plugins"
+	if err := os.MkdirAll(pluginsDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+pluginsDir)
+		return errors.New(err.Error())
+	}
+
+	var plugins []*pluginInfo
+	installed := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		plugin, err := inspectPlugin(filepath.Join(serverDir, entry.Name()), clientDir, config, serverVersion)
+		if err != nil {
+			LogMessage(warningLevel, "Unable to read plugin in "+entry.Name()+": "+err.Error())
+			AddSummaryFinding(warningLevel, pluginsArea, "The plugin in "+entry.Name()+" has no usable manifest: "+err.Error())
+			continue
+		}
+		plugins = append(plugins, plugin)
+		installed[plugin.ID] = true
+
+		copyPluginLogs(plugin, pluginsDir)
+
+		for _, problem := range plugin.Problems {
+			level := warningLevel
+			if plugin.Enabled {
+				level = errorLevel
+			}
+			AddSummaryFinding(level, pluginsArea, plugin.ID+": "+problem)
+		}
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].ID < plugins[j].ID })
+
+	file, err := os.Create(pluginsDir + "/plugins.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for plugin inventory in "+pluginsDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+	writePluginInventory(file, config, serverDir, clientDir, plugins)
+
+	// Plugins enabled in the config but not installed can't be started
+	var missing []string
+	for id, enabled := range config.PluginStates {
+		if enabled && !installed[id] {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		fmt.Fprintf(file, "\nEnabled in PluginSettings.PluginStates, but not installed:\n")
+		for _, id := range missing {
+			fmt.Fprintf(file, "  %s\n", id)
+		}
+		AddSummaryFinding(warningLevel, pluginsArea, fmt.Sprintf("%d plugins are enabled in the config but not installed: %s", len(missing), strings.Join(missing, ", ")))
+	}
+
+	content, err := json.MarshalIndent(plugins, "", "  ")
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	if err := os.WriteFile(pluginsDir+"/plugins.json", content, 0644); err != nil {
+		LogMessage(warningLevel, "Unable to write plugins.json: "+err.Error())
+		return errors.New(err.Error())
+	}
+
+	AddSummaryFinding(infoLevel, pluginsArea, fmt.Sprintf("%d plugins are installed - see plugins/plugins.txt", len(plugins)))
+	return nil
+}
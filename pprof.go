@@ -0,0 +1,209 @@
+// Package main contains the Go runtime diagnostics collector, which fetches profiles from a running Mattermost server
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runtimeArea is the area name used for summary findings relating to the Go runtime diagnostics
+const runtimeArea = "Go Runtime"
+
+const (
+	// defaultMetricsListenAddress is Mattermost's default for MetricsSettings.ListenAddress
+	defaultMetricsListenAddress = ":8067"
+	// pprofRequestTimeout limits how long we'll wait for a profile.  A hung server may never respond, and we don't
+	// want to hang with it.
+	pprofRequestTimeout = 30 * time.Second
+	// blockedGoroutineMinutes is how long a goroutine must have been waiting on a lock before we report it
+	blockedGoroutineMinutes = 5
+)
+
+// pprofProfiles lists the profiles we collect, and the files they're written to.  We ask for the text forms
+// (debug=1/2), so that they can be read without the Go toolchain and can be obfuscated like any other text file.
+var pprofProfiles = []struct {
+	Path string
+	File string
+}{
+	{"/debug/pprof/goroutine?debug=2", "goroutines.txt"},
+	{"/debug/pprof/goroutine?debug=1", "goroutine-summary.txt"},
+	{"/debug/pprof/heap?debug=1", "heap.txt"},
+}
+
+// goroutineHeaderPattern matches the header of each goroutine in a debug=2 goroutine dump, e.g.
+// "goroutine 123 [sync.Mutex.Lock, 15 minutes]:"
+var goroutineHeaderPattern = regexp.MustCompile(`(?m)^goroutine \d+ \[([^,\]]+)(?:, (\d+) minutes)?`)
+
+// lockWaitStates are the goroutine wait reasons that indicate a goroutine is waiting for a lock.  Long waits in these
+// states (unlike e.g. "select" or "IO wait", which are normal for idle workers) suggest a deadlock.
+var lockWaitStates = map[string]bool{
+	"semacquire":         true,
+	"sync.Mutex.Lock":    true,
+	"sync.RWMutex.Lock":  true,
+	"sync.RWMutex.RLock": true,
+}
+
+// metricsBaseURL works out where the metrics server is listening, from MetricsSettings.ListenAddress.  The server
+// usually listens on all interfaces, so we connect via localhost.
+func metricsBaseURL(listenAddress string) string {
+	if listenAddress == "" {
+		listenAddress = defaultMetricsListenAddress
+	}
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		host, port = "", strings.TrimPrefix(listenAddress, ":")
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// fetchProfile downloads a single profile to the given file
+func fetchProfile(client *http.Client, profileURL string, outputFile string) error {
+	DebugPrint("Fetching profile: " + profileURL)
+
+	response, err := client.Get(profileURL)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", profileURL, response.Status)
+	}
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, response.Body)
+	return err
+}
+
+// analyseGoroutineDump reports the total number of goroutines, and any that have been waiting on a lock for a long time
+func analyseGoroutineDump(dumpFile string) {
+	content, err := os.ReadFile(dumpFile)
+	if err != nil {
+		return
+	}
+
+	total := 0
+	blocked := make(map[string]int)
+	for _, matches := range goroutineHeaderPattern.FindAllStringSubmatch(string(content), -1) {
+		total++
+		if !lockWaitStates[matches[1]] || matches[2] == "" {
+			continue
+		}
+		if minutes, _ := strconv.Atoi(matches[2]); minutes >= blockedGoroutineMinutes {
+			blocked[matches[1]]++
+		}
+	}
+
+	AddSummaryFinding(infoLevel, runtimeArea, fmt.Sprintf("Mattermost has %d goroutines - see pprof/goroutines.txt", total))
+
+	states := make([]string, 0, len(blocked))
+	for state := range blocked {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		AddSummaryFinding(warningLevel, runtimeArea, fmt.Sprintf("%d goroutines have been waiting in %s for %d minutes or more - possible deadlock", blocked[state], state, blockedGoroutineMinutes))
+	}
+}
+
+// summariseHeapProfile extracts the key memory statistics from the end of a debug=1 heap profile
+func summariseHeapProfile(profileFile string) {
+	content, err := os.ReadFile(profileFile)
+	if err != nil {
+		return
+	}
+
+	var heapInuse, sys int64
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// The runtime.MemStats section looks like "# HeapInuse = 123456"
+		name, value, found := strings.Cut(strings.TrimPrefix(scanner.Text(), "# "), " = ")
+		if !found {
+			continue
+		}
+		switch name {
+		case "HeapInuse":
+			heapInuse, _ = strconv.ParseInt(value, 10, 64)
+		case "Sys":
+			sys, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if sys > 0 {
+		AddSummaryFinding(infoLevel, runtimeArea, fmt.Sprintf("Mattermost heap in use is %s, with %s obtained from the OS", formatBytes(heapInuse), formatBytes(sys)))
+	}
+}
+
+// CollectRuntimeProfiles fetches Go runtime diagnostics from a running Mattermost server, via the pprof endpoints
+// served by the metrics server (MetricsSettings).  We collect a full goroutine dump - the single most useful artifact
+// for a hung server - along with a goroutine summary and a heap profile.  This avoids the traditional approach of
+// sending SIGQUIT, which dumps the goroutines but also kills the server.  If cpuProfileSeconds is greater than zero,
+// a CPU profile of that duration is also captured.  Every request has a timeout, so a hung server can't hang us too.
+// The parsed config, the CPU profile duration and the temp directory are passed as parameters, and the function
+// returns an error object (nil on success).
+// The profiles are written to the pprof directory in the temp directory.
+func CollectRuntimeProfiles(config *mmConfig, cpuProfileSeconds int, targetDir string) error {
+	DebugPrint("Collecting Go runtime profiles - writing to: " + targetDir)
+
+	if !config.MetricsEnabled {
+		LogMessage(infoLevel, "Metrics are disabled, so Go runtime profiles can't be collected")
+		AddSummaryFinding(infoLevel, runtimeArea, "MetricsSettings.Enable is false, so goroutine dumps and profiles could not be collected")
+		return nil
+	}
+
+	baseURL := metricsBaseURL(config.MetricsListenAddress)
+	client := &http.Client{Timeout: pprofRequestTimeout}
+
+	pprofDir := targetDir + "/pprof"
+	if err := os.MkdirAll(pprofDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+pprofDir)
+		return errors.New(err.Error())
+	}
+
+	for index, profile := range pprofProfiles {
+		outputFile := pprofDir + "/" + profile.File
+		if err := fetchProfile(client, baseURL+profile.Path, outputFile); err != nil {
+			os.Remove(outputFile)
+			if index == 0 {
+				// If we can't get the goroutine dump, the server isn't responding, so don't wait for the others
+				AddSummaryFinding(warningLevel, runtimeArea, "Unable to fetch a goroutine dump from the metrics server at "+baseURL)
+				return errors.New(err.Error())
+			}
+			LogMessage(warningLevel, "Failed to fetch "+profile.File+": "+err.Error())
+		}
+	}
+
+	analyseGoroutineDump(pprofDir + "/goroutines.txt")
+	summariseHeapProfile(pprofDir + "/heap.txt")
+
+	if cpuProfileSeconds > 0 {
+		LogMessage(infoLevel, fmt.Sprintf("Capturing a %d second CPU profile", cpuProfileSeconds))
+		cpuClient := &http.Client{Timeout: time.Duration(cpuProfileSeconds)*time.Second + pprofRequestTimeout}
+		profileURL := fmt.Sprintf("%s/debug/pprof/profile?seconds=%d", baseURL, cpuProfileSeconds)
+		if err := fetchProfile(cpuClient, profileURL, pprofDir+"/cpu.pb.gz"); err != nil {
+			os.Remove(pprofDir + "/cpu.pb.gz")
+			LogMessage(warningLevel, "Failed to capture CPU profile: "+err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+// Package main contains the process snapshot collector, which reads the process table directly from /proc
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// processSampleInterval is the time between the two samples used to calculate CPU usage
+	processSampleInterval = 1 * time.Second
+	// maxTableCmdlineLength limits the length of command lines in the process table.  Full command lines are
+	// included in the detailed section and in processes.json.
+	maxTableCmdlineLength = 120
+)
+
+// Categories of processes that get a detailed section in the snapshot
+const (
+	processCategoryMattermost = "mattermost"
+	processCategoryPlugin     = "plugin"
+	processCategoryDatabase   = "database"
+)
+
+// databaseProcessNames lists the process names used by the databases Mattermost supports
+var databaseProcessNames = map[string]bool{"postgres": true, "postmaster": true, "mysqld": true, "mariadbd": true}
+
+// processInfo is a single entry in the process snapshot.  It is written to processes.json as-is.
+type processInfo struct {
+	PID           int     `json:"pid"`
+	PPID          int     `json:"ppid"`
+	User          string  `json:"user"`
+	State         string  `json:"state"`
+	CPUPercent    float64 `json:"cpu_percent"`
+	MemoryPercent float64 `json:"memory_percent"`
+	RSSBytes      int64   `json:"rss_bytes"`
+	VSizeBytes    uint64  `json:"vsize_bytes"`
+	Threads       int     `json:"threads"`
+	OpenFiles     int     `json:"open_files"`
+	StartTime     string  `json:"start_time,omitempty"`
+	Name          string  `json:"name"`
+	Exe           string  `json:"exe,omitempty"`
+	Cmdline       string  `json:"cmdline"`
+	Category      string  `json:"category,omitempty"`
+}
+
+// processSnapshot is the complete snapshot, as written to processes.json
+type processSnapshot struct {
+	Timestamp      string        `json:"timestamp"`
+	SampleInterval float64       `json:"sample_interval_seconds"`
+	LoadAverage    string        `json:"load_average"`
+	UptimeSeconds  float64       `json:"uptime_seconds"`
+	MemoryTotal    int64         `json:"memory_total_bytes"`
+	MemoryAvail    int64         `json:"memory_available_bytes"`
+	Processes      []processInfo `json:"processes"`
+}
+
+// processCPUTicks returns the total CPU time (user + system) used by each process, in clock ticks
+func processCPUTicks() map[int]uint64 {
+	ticks := make(map[int]uint64)
+	for _, pid := range listProcessIDs() {
+		if stat, err := readProcStat(pid); err == nil {
+			ticks[pid] = stat.UTime + stat.STime
+		}
+	}
+	return ticks
+}
+
+// categoriseProcess works out whether a process is Mattermost, a Mattermost plugin or a database server.  Plugins
+// run as separate processes whose executables live under the plugins directory.
+func categoriseProcess(name string, exe string) string {
+	switch {
+	case filepath.Base(exe) == "mattermost":
+		return processCategoryMattermost
+	case strings.Contains(exe, "/plugins/"):
+		return processCategoryPlugin
+	case databaseProcessNames[name]:
+		return processCategoryDatabase
+	default:
+		return ""
+	}
+}
+
+// readSystemUptime returns the system uptime in seconds, from /proc/uptime
+func readSystemUptime() float64 {
+	content, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0
+	}
+	uptime, _ := strconv.ParseFloat(fields[0], 64)
+	return uptime
+}
+
+// takeProcessSnapshot reads every process from /proc.  CPU usage is calculated from two samples of each process's
+// CPU time, taken processSampleInterval apart, in the same way as top.
+func takeProcessSnapshot() *processSnapshot {
+	snapshot := &processSnapshot{SampleInterval: processSampleInterval.Seconds()}
+
+	firstSample := processCPUTicks()
+	time.Sleep(processSampleInterval)
+
+	snapshot.Timestamp = time.Now().Format(time.RFC3339)
+	snapshot.UptimeSeconds = readSystemUptime()
+	if loadavg, err := os.ReadFile("/proc/loadavg"); err == nil {
+		fields := strings.Fields(string(loadavg))
+		if len(fields) >= 3 {
+			snapshot.LoadAverage = strings.Join(fields[:3], " ")
+		}
+	}
+	if meminfo, err := readMeminfo(); err == nil {
+		snapshot.MemoryTotal = meminfo["MemTotal"]
+		snapshot.MemoryAvail = meminfo["MemAvailable"]
+	}
+
+	bootTime, err := systemBootTime()
+	if err != nil {
+		DebugPrint("Unable to determine boot time: " + err.Error())
+	}
+	pageSize := int64(os.Getpagesize())
+
+	for _, pid := range listProcessIDs() {
+		stat, err := readProcStat(pid)
+		if err != nil {
+			// The process has probably exited since we listed /proc
+			continue
+		}
+
+		process := processInfo{
+			PID:        pid,
+			PPID:       stat.PPID,
+			State:      stat.State,
+			RSSBytes:   stat.RSSPages * pageSize,
+			VSizeBytes: stat.VSize,
+			Threads:    stat.NumThreads,
+			Name:       stat.Comm,
+			Exe:        readProcessExe(pid),
+			Cmdline:    readProcessCmdline(pid),
+		}
+		if process.Cmdline == "" {
+			// Kernel threads have no command line, so we show their name in brackets, as ps and top do
+			process.Cmdline = "[" + stat.Comm + "]"
+		}
+		if uid, err := processUID(pid); err == nil {
+			process.User = lookupUsername(uid)
+		}
+		process.OpenFiles, _ = countOpenFiles(pid)
+		if !bootTime.IsZero() {
+			process.StartTime = processStartTime(stat, bootTime).Format(time.RFC3339)
+		}
+		// A PID that has been reused since the first sample will have used less CPU time, so is ignored
+		if previous, ok := firstSample[pid]; ok && stat.UTime+stat.STime >= previous {
+			used := float64(stat.UTime + stat.STime - previous)
+			process.CPUPercent = used / clockTicksPerSecond / processSampleInterval.Seconds() * 100
+		}
+		if snapshot.MemoryTotal > 0 {
+			process.MemoryPercent = float64(process.RSSBytes) / float64(snapshot.MemoryTotal) * 100
+		}
+		process.Category = categoriseProcess(stat.Comm, process.Exe)
+
+		snapshot.Processes = append(snapshot.Processes, process)
+	}
+
+	// Sort by resource use: CPU first, then memory
+	sort.SliceStable(snapshot.Processes, func(i, j int) bool {
+		a, b := snapshot.Processes[i], snapshot.Processes[j]
+		if a.CPUPercent != b.CPUPercent {
+			return a.CPUPercent > b.CPUPercent
+		}
+		if a.RSSBytes != b.RSSBytes {
+			return a.RSSBytes > b.RSSBytes
+		}
+		return a.PID < b.PID
+	})
+
+	return snapshot
+}
+
+// writeProcessDetails writes the detailed section for a Mattermost, plugin or database process
+func writeProcessDetails(w io.Writer, process processInfo) {
+	fmt.Fprintf(w, "[%s] PID %d (%s)\n", process.Category, process.PID, process.Name)
+	fmt.Fprintf(w, "  Executable:   %s\n", process.Exe)
+	fmt.Fprintf(w, "  Command Line: %s\n", process.Cmdline)
+	if cwd, err := os.Readlink("/proc/" + strconv.Itoa(process.PID) + "/cwd"); err == nil {
+		fmt.Fprintf(w, "  Working Dir:  %s\n", cwd)
+	}
+	fmt.Fprintf(w, "  User:         %s\n", process.User)
+	if parent, err := readProcStat(process.PPID); err == nil {
+		fmt.Fprintf(w, "  Parent:       %d (%s)\n", process.PPID, parent.Comm)
+	} else {
+		fmt.Fprintf(w, "  Parent:       %d\n", process.PPID)
+	}
+	fmt.Fprintf(w, "  Started:      %s\n", process.StartTime)
+	fmt.Fprintf(w, "  State:        %s\n", process.State)
+	fmt.Fprintf(w, "  CPU:          %.1f%%\n", process.CPUPercent)
+	fmt.Fprintf(w, "  Threads:      %d\n", process.Threads)
+	fmt.Fprintf(w, "  Open Files:   %d\n", process.OpenFiles)
+
+	if status, err := readProcessStatus(process.PID); err == nil {
+		fmt.Fprintf(w, "  Memory:       RSS %s (peak %s), virtual %s (peak %s), swap %s\n",
+			formatBytes(parseStatusKilobytes(status["VmRSS"])),
+			formatBytes(parseStatusKilobytes(status["VmHWM"])),
+			formatBytes(parseStatusKilobytes(status["VmSize"])),
+			formatBytes(parseStatusKilobytes(status["VmPeak"])),
+			formatBytes(parseStatusKilobytes(status["VmSwap"])))
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// writeProcessSnapshotText writes the snapshot in a form similar to top: a header with the system load and memory,
+// followed by the process table and the detailed section.
+func writeProcessSnapshotText(w io.Writer, snapshot *processSnapshot) {
+	fmt.Fprintf(w, "Process snapshot at %s (CPU usage sampled over %.0fs)\n", snapshot.Timestamp, snapshot.SampleInterval)
+	fmt.Fprintf(w, "Uptime:       %s\n", (time.Duration(snapshot.UptimeSeconds) * time.Second).String())
+	fmt.Fprintf(w, "Load Average: %s\n", snapshot.LoadAverage)
+	fmt.Fprintf(w, "Memory:       %s total, %s available\n", formatBytes(snapshot.MemoryTotal), formatBytes(snapshot.MemoryAvail))
+
+	states := make(map[string]int)
+	for _, process := range snapshot.Processes {
+		states[process.State]++
+	}
+	fmt.Fprintf(w, "Processes:    %d total, %d running, %d sleeping, %d uninterruptible, %d zombie\n\n",
+		len(snapshot.Processes), states["R"], states["S"]+states["I"], states["D"], states["Z"])
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(table, "PID\tUSER\tS\t%%CPU\t%%MEM\tRSS\tTHR\tFDS\tSTARTED\t COMMAND\n")
+	for _, process := range snapshot.Processes {
+		cmdline := process.Cmdline
+		if len(cmdline) > maxTableCmdlineLength {
+			cmdline = cmdline[:maxTableCmdlineLength] + "..."
+		}
+		started := process.StartTime
+		if len(started) > 19 {
+			started = strings.Replace(started[:19], "T", " ", 1)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%.1f\t%.1f\t%s\t%d\t%d\t%s\t %s\n", process.PID, process.User, process.State,
+			process.CPUPercent, process.MemoryPercent, formatBytes(process.RSSBytes), process.Threads, process.OpenFiles,
+			started, cmdline)
+	}
+	table.Flush()
+
+	fmt.Fprintf(w, "\nMattermost, Plugin and Database Processes\n\n")
+	found := false
+	for _, process := range snapshot.Processes {
+		if process.Category != "" {
+			writeProcessDetails(w, process)
+			found = true
+		}
+	}
+	if !found {
+		fmt.Fprintf(w, "None found.\n")
+	}
+}
+
+// CollectProcessSnapshot reads the process table directly from /proc, rather than relying on `top`, whose output
+// varies between versions and which may not be installed in minimal images.  The table includes each process's
+// user, state, CPU and memory usage, threads, open files, start time and command line, sorted by resource use.
+// Mattermost, plugin and database processes also get a detailed section.
+// The temp directory is passed as a parameter, and the function returns an error object (nil on success).
+// The snapshot is written to processes.txt, and in machine-readable form to processes.json.
+func CollectProcessSnapshot(targetDir string) error {
+	DebugPrint("Taking process snapshot - writing to: " + targetDir)
+
+	snapshot := takeProcessSnapshot()
+	if len(snapshot.Processes) == 0 {
+		LogMessage(warningLevel, "No processes could be read from /proc")
+		return errors.New("no processes found in /proc")
+	}
+
+	file, err := os.Create(targetDir + "/processes.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for process snapshot in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+	writeProcessSnapshotText(file, snapshot)
+
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	if err := os.WriteFile(targetDir+"/processes.json", content, 0644); err != nil {
+		LogMessage(errorLevel, "Unable to write processes.json in "+targetDir)
+		return errors.New(err.Error())
+	}
+
+	return nil
+}
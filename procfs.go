@@ -0,0 +1,243 @@
+// Package main contains helpers for reading process information from /proc
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicksPerSecond is the kernel's USER_HZ, used for the CPU times and start time in /proc/<pid>/stat.  This is
+// 100 on every Linux architecture we support, and reading it properly would require cgo (sysconf).
+const clockTicksPerSecond = 100
+
+// procStat holds the fields we use from /proc/<pid>/stat
+type procStat struct {
+	PID        int
+	Comm       string
+	State      string
+	PPID       int
+	UTime      uint64
+	STime      uint64
+	NumThreads int
+	StartTicks uint64
+	VSize      uint64
+	RSSPages   int64
+}
+
+// listProcessIDs returns the IDs of all processes currently running
+func listProcessIDs() []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		LogMessage(warningLevel, "Unable to read /proc: "+err.Error())
+		return nil
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// readProcStat parses /proc/<pid>/stat.  The command name is enclosed in parentheses and may itself contain spaces
+// or parentheses, so the remaining fields are split from after the last closing parenthesis.
+func readProcStat(pid int) (*procStat, error) {
+	content, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, err
+	}
+
+	line := string(content)
+	open := strings.Index(line, "(")
+	end := strings.LastIndex(line, ")")
+	if open == -1 || end == -1 || end < open {
+		return nil, errors.New("unable to parse /proc/" + strconv.Itoa(pid) + "/stat")
+	}
+
+	// fields[0] is field 3 (state) in the proc(5) numbering
+	fields := strings.Fields(line[end+1:])
+	if len(fields) < 22 {
+		return nil, errors.New("unexpected format in /proc/" + strconv.Itoa(pid) + "/stat")
+	}
+
+	stat := &procStat{PID: pid, Comm: line[open+1 : end], State: fields[0]}
+	stat.PPID, _ = strconv.Atoi(fields[1])
+	stat.UTime, _ = strconv.ParseUint(fields[11], 10, 64)
+	stat.STime, _ = strconv.ParseUint(fields[12], 10, 64)
+	stat.NumThreads, _ = strconv.Atoi(fields[17])
+	stat.StartTicks, _ = strconv.ParseUint(fields[19], 10, 64)
+	stat.VSize, _ = strconv.ParseUint(fields[20], 10, 64)
+	stat.RSSPages, _ = strconv.ParseInt(fields[21], 10, 64)
+
+	return stat, nil
+}
+
+// systemBootTime returns the time the system booted, from the btime line in /proc/stat
+func systemBootTime() (time.Time, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("btime not found in /proc/stat")
+}
+
+// processStartTime converts the start time from /proc/<pid>/stat (in clock ticks since boot) into a time
+func processStartTime(stat *procStat, bootTime time.Time) time.Time {
+	return bootTime.Add(time.Duration(stat.StartTicks) * time.Second / clockTicksPerSecond)
+}
+
+// processUID returns the real user ID of a process, from /proc/<pid>/status
+func processUID(pid int) (string, error) {
+	file, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "Uid:" {
+			return fields[1], nil
+		}
+	}
+	return "", errors.New("Uid not found in /proc/" + strconv.Itoa(pid) + "/status")
+}
+
+// usernameCache avoids repeated user lookups when building process tables
+var usernameCache = make(map[string]string)
+
+// lookupUsername converts a user ID into a username, falling back to the numeric ID if the user can't be found
+func lookupUsername(uid string) string {
+	if name, ok := usernameCache[uid]; ok {
+		return name
+	}
+	name := uid
+	if found, err := user.LookupId(uid); err == nil {
+		name = found.Username
+	}
+	usernameCache[uid] = name
+	return name
+}
+
+// readProcessCmdline returns the command line of a process, with the arguments separated by spaces
+func readProcessCmdline(pid int) string {
+	content, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(content), "\x00", " "))
+}
+
+// readProcessExe returns the path of the executable a process is running.  If the binary has been replaced since
+// the process started (e.g. during an upgrade), the kernel appends " (deleted)", which we strip.
+func readProcessExe(pid int) string {
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(exe, " (deleted)")
+}
+
+// findMattermostProcesses returns the IDs of any running Mattermost server processes.  A process matches if its
+// executable is the server binary in the install directory, or any binary named "mattermost" (for installs in a
+// non-standard location).
+func findMattermostProcesses(mmDir string) []int {
+	expected := filepath.Join(mmDir, "bin", "mattermost")
+
+	var pids []int
+	for _, pid := range listProcessIDs() {
+		exe := readProcessExe(pid)
+		if exe == "" {
+			continue
+		}
+		if exe == expected || filepath.Base(exe) == "mattermost" {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// readProcessStatus parses /proc/<pid>/status into a map of field names to values, e.g. "VmRSS" => "10240 kB"
+func readProcessStatus(pid int) (map[string]string, error) {
+	file, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	status := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if name, value, found := strings.Cut(scanner.Text(), ":"); found {
+			status[name] = strings.TrimSpace(value)
+		}
+	}
+	return status, scanner.Err()
+}
+
+// countOpenFiles returns the number of open file descriptors of a process
+func countOpenFiles(pid int) (int, error) {
+	entries, err := os.ReadDir("/proc/" + strconv.Itoa(pid) + "/fd")
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// readMeminfo parses /proc/meminfo, returning the values in bytes, e.g. "MemTotal" => 8167952384
+func readMeminfo() (map[string]int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	meminfo := make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		meminfo[strings.TrimSuffix(fields[0], ":")] = value
+	}
+	return meminfo, scanner.Err()
+}
+
+// parseStatusKilobytes converts a memory value from /proc/<pid>/status (e.g. "10240 kB") into bytes
+func parseStatusKilobytes(value string) int64 {
+	kilobytes, err := strconv.ParseInt(strings.TrimSuffix(value, " kB"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return kilobytes * 1024
+}
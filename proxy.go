@@ -0,0 +1,786 @@
+// Package main contains the reverse proxy (nginx, Apache and HAProxy) configuration collector
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reverseProxyArea is the area name used for summary findings from the reverse proxy collector
+const reverseProxyArea = "Reverse Proxy"
+
+// Locations in which we look for reverse proxy configuration.  These cover the standard package layouts for the
+// distros we support, as well as source installs.
+var (
+	nginxConfigPaths = []string{
+		"/etc/nginx/nginx.conf",
+		"/etc/nginx/conf.d/*.conf",
+		"/etc/nginx/sites-enabled/*",
+		"/etc/nginx/default.d/*.conf",
+		"/usr/local/nginx/conf/nginx.conf",
+		"/usr/local/etc/nginx/nginx.conf",
+	}
+	apacheConfigPaths = []string{
+		"/etc/apache2/apache2.conf",
+		"/etc/apache2/sites-enabled/*",
+		"/etc/apache2/conf-enabled/*",
+		"/etc/httpd/conf/httpd.conf",
+		"/etc/httpd/conf.d/*.conf",
+	}
+	haproxyConfigPaths = []string{
+		"/etc/haproxy/haproxy.cfg",
+		"/etc/haproxy/conf.d/*.cfg",
+	}
+)
+
+// nginxDirective is a single directive from an nginx config file.  Block directives (server, location, etc.) hold
+// their nested directives in Children.  Start and End are offsets into Source (the content of the file the directive
+// was read from, which may be an included file), so we can extract the raw text.
+type nginxDirective struct {
+	Name     string
+	Args     []string
+	Children []*nginxDirective
+	Block    bool
+	Source   string
+	Start    int
+	End      int
+}
+
+// nginxToken is a single token from an nginx config file, along with its position in the source
+type nginxToken struct {
+	Value  string
+	Quoted bool
+	Start  int
+	End    int
+}
+
+// nginxMaxIncludeDepth limits how deeply nested include directives are followed, in case of an include loop
+const nginxMaxIncludeDepth = 8
+
+// nginxFile holds a parsed nginx config file
+type nginxFile struct {
+	Path       string
+	Directives []*nginxDirective
+}
+
+// discoverConfigFiles expands a list of glob patterns into the regular files that exist on this host.  Files that
+// are reached more than once (e.g. sites-enabled symlinks into sites-available) are only returned once.
+func discoverConfigFiles(patterns []string) []string {
+	var files []string
+	seen := make(map[string]bool)
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			resolved, err := filepath.EvalSymlinks(match)
+			if err != nil {
+				resolved = match
+			}
+			if seen[resolved] {
+				continue
+			}
+			seen[resolved] = true
+			files = append(files, match)
+		}
+	}
+
+	return files
+}
+
+// captureConfigFiles copies each config file into the target directory.  The full path of the original file is
+// encoded in the name of the copy, so that files with the same name in different directories don't collide.
+func captureConfigFiles(files []string, targetDir string) {
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		LogMessage(warningLevel, "Failed to create directory: "+targetDir)
+		return
+	}
+
+	for _, path := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			LogMessage(warningLevel, "Failed to read config file "+path+": "+err.Error())
+			continue
+		}
+		copyName := strings.ReplaceAll(strings.TrimPrefix(path, "/"), "/", "_")
+		if err := os.WriteFile(filepath.Join(targetDir, copyName), content, 0644); err != nil {
+			LogMessage(warningLevel, "Failed to capture config file "+path+": "+err.Error())
+		}
+	}
+}
+
+// tokeniseNginxConfig splits nginx config into tokens, removing comments.  Braces and semicolons are returned as
+// separate tokens.
+func tokeniseNginxConfig(content string) []nginxToken {
+	var tokens []nginxToken
+
+	i := 0
+	for i < len(content) {
+		c := content[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, nginxToken{Value: string(c), Start: i, End: i + 1})
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var value strings.Builder
+			for i < len(content) && content[i] != c {
+				if content[i] == '\\' && i+1 < len(content) {
+					i++
+				}
+				value.WriteByte(content[i])
+				i++
+			}
+			i++
+			tokens = append(tokens, nginxToken{Value: value.String(), Quoted: true, Start: start, End: i})
+		default:
+			start := i
+			for i < len(content) && !strings.ContainsRune(" \t\r\n{};", rune(content[i])) {
+				i++
+			}
+			tokens = append(tokens, nginxToken{Value: content[start:i], Start: start, End: i})
+		}
+	}
+
+	return tokens
+}
+
+// parseNginxConfig parses nginx config into a tree of directives.  The parser is deliberately forgiving - we're
+// trying to extract useful information from whatever the customer has, not to validate it.
+func parseNginxConfig(content string) []*nginxDirective {
+	tokens := tokeniseNginxConfig(content)
+	position := 0
+	return parseNginxBlock(content, tokens, &position)
+}
+
+// parseNginxBlock parses directives until the end of the current block (or the end of the file)
+func parseNginxBlock(content string, tokens []nginxToken, position *int) []*nginxDirective {
+	var directives []*nginxDirective
+
+	for *position < len(tokens) {
+		token := tokens[*position]
+		if token.Value == "}" && !token.Quoted {
+			*position++
+			return directives
+		}
+
+		directive := &nginxDirective{Name: token.Value, Source: content, Start: token.Start, End: token.End}
+		*position++
+
+		for *position < len(tokens) {
+			token = tokens[*position]
+			*position++
+			if !token.Quoted && token.Value == ";" {
+				directive.End = token.End
+				break
+			}
+			if !token.Quoted && token.Value == "{" {
+				directive.Block = true
+				directive.Children = parseNginxBlock(content, tokens, position)
+				directive.End = tokens[*position-1].End
+				break
+			}
+			directive.Args = append(directive.Args, token.Value)
+		}
+
+		directives = append(directives, directive)
+	}
+
+	return directives
+}
+
+// nginxIncludes expands the include directives in a directive tree, replacing each with the directives from the files
+// it matches.  As in nginx, relative paths are resolved against the prefix (the directory holding nginx.conf) and may be
+// globs.  Files in analysed are skipped, as they're analysed in their own right, and includes that match nothing or
+// can't be read are left in place, so the analysis can tell that part of a block is missing.  The path of every file
+// that was included is added to included.
+func expandNginxIncludes(directives []*nginxDirective, prefix string, analysed map[string]bool, included map[string]bool, depth int) []*nginxDirective {
+	var expanded []*nginxDirective
+
+	for _, directive := range directives {
+		if directive.Block {
+			directive.Children = expandNginxIncludes(directive.Children, prefix, analysed, included, depth)
+		}
+		if directive.Name != "include" || directive.Block || len(directive.Args) == 0 || depth >= nginxMaxIncludeDepth {
+			expanded = append(expanded, directive)
+			continue
+		}
+
+		pattern := directive.Args[0]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(prefix, pattern)
+		}
+		matches, _ := filepath.Glob(pattern)
+
+		resolved := false
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if realPath, err := filepath.EvalSymlinks(match); err == nil && analysed[realPath] {
+				resolved = true
+				continue
+			}
+			content, err := os.ReadFile(match)
+			if err != nil {
+				DebugPrint("Unable to read nginx include " + match + ": " + err.Error())
+				continue
+			}
+			resolved = true
+			included[match] = true
+			expanded = append(expanded, expandNginxIncludes(parseNginxConfig(string(content)), prefix, analysed, included, depth+1)...)
+		}
+
+		if !resolved {
+			expanded = append(expanded, directive)
+		}
+	}
+
+	return expanded
+}
+
+// findNginxDirectives returns the directives with the given name from a list (not recursive)
+func findNginxDirectives(directives []*nginxDirective, name string) []*nginxDirective {
+	var found []*nginxDirective
+	for _, directive := range directives {
+		if directive.Name == name {
+			found = append(found, directive)
+		}
+	}
+	return found
+}
+
+// findNginxLocations returns all location blocks within a server block, including nested locations
+func findNginxLocations(directives []*nginxDirective) []*nginxDirective {
+	var locations []*nginxDirective
+	for _, directive := range directives {
+		if directive.Name == "location" && directive.Block {
+			locations = append(locations, directive)
+			locations = append(locations, findNginxLocations(directive.Children)...)
+		}
+	}
+	return locations
+}
+
+// proxyTargetHost extracts the host (and port) from a proxy target such as "http://127.0.0.1:8065/" or "http://backend"
+func proxyTargetHost(target string) string {
+	if index := strings.Index(target, "://"); index != -1 {
+		target = target[index+3:]
+	}
+	if index := strings.IndexAny(target, "/?"); index != -1 {
+		target = target[:index]
+	}
+	return target
+}
+
+// targetsPort returns true if a host:port address refers to the given port
+func targetsPort(address string, port string) bool {
+	return strings.HasSuffix(address, ":"+port)
+}
+
+// parseNginxSize converts an nginx size (e.g. "50m", "1G", "1024") into bytes
+func parseNginxSize(size string) (int64, error) {
+	multiplier := int64(1)
+	lower := strings.ToLower(size)
+	switch {
+	case strings.HasSuffix(lower, "k"):
+		multiplier = 1024
+	case strings.HasSuffix(lower, "m"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(lower, "g"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	value, err := strconv.ParseInt(strings.TrimRight(lower, "kmg"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
+
+// formatBytes formats a size in bytes in a human-readable form
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// effectiveNginxDirective returns the first directive with the given name, searching from the innermost level
+// (location) outwards (server, then http).  This mirrors how nginx inherits most directives.
+func effectiveNginxDirective(levels [][]*nginxDirective, name string) *nginxDirective {
+	for _, level := range levels {
+		if found := findNginxDirectives(level, name); len(found) > 0 {
+			return found[len(found)-1]
+		}
+	}
+	return nil
+}
+
+// effectiveNginxHeaders returns the proxy_set_header directives in effect at the innermost level.  Unlike most
+// directives, proxy_set_header is only inherited if no proxy_set_header directives are defined at the current level.
+func effectiveNginxHeaders(levels [][]*nginxDirective) map[string]string {
+	headers := make(map[string]string)
+	for _, level := range levels {
+		found := findNginxDirectives(level, "proxy_set_header")
+		if len(found) == 0 {
+			continue
+		}
+		for _, directive := range found {
+			if len(directive.Args) >= 2 {
+				headers[strings.ToLower(directive.Args[0])] = directive.Args[1]
+			}
+		}
+		break
+	}
+	return headers
+}
+
+// analyseNginx finds the nginx server blocks that proxy to Mattermost and checks them for the settings Mattermost
+// needs: websocket upgrade headers, HTTP/1.1 to the upstream and a client_max_body_size large enough for uploads.
+// Include directives are followed, and the paths of the included files are returned so they can be captured too.
+func analyseNginx(w io.Writer, files []string, config *mmConfig) []string {
+	fmt.Fprintf(w, "nginx\n=====\n")
+
+	// Relative includes are resolved against the directory holding nginx.conf
+	prefix := "/etc/nginx"
+	analysed := make(map[string]bool)
+	for _, path := range files {
+		if filepath.Base(path) == "nginx.conf" {
+			prefix = filepath.Dir(path)
+		}
+		if realPath, err := filepath.EvalSymlinks(path); err == nil {
+			analysed[realPath] = true
+		}
+	}
+
+	var parsed []nginxFile
+	included := make(map[string]bool)
+	for _, path := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(w, "Unable to read %s: %s\n", path, err.Error())
+			continue
+		}
+		directives := expandNginxIncludes(parseNginxConfig(string(content)), prefix, analysed, included, 0)
+		parsed = append(parsed, nginxFile{Path: path, Directives: directives})
+	}
+
+	// Directives in the main nginx.conf live inside the http block, whereas included files (conf.d, sites-enabled)
+	// are included from within the http block, so their top-level directives are at the http level.
+	httpLevel := make(map[string][]*nginxDirective)
+	var globalHTTPLevel []*nginxDirective
+	for _, file := range parsed {
+		if filepath.Base(file.Path) == "nginx.conf" {
+			for _, http := range findNginxDirectives(file.Directives, "http") {
+				httpLevel[file.Path] = append(httpLevel[file.Path], http.Children...)
+				globalHTTPLevel = append(globalHTTPLevel, http.Children...)
+			}
+		} else {
+			httpLevel[file.Path] = file.Directives
+		}
+	}
+
+	// Upstreams can be defined in any file, so we gather them all before looking at the server blocks
+	mattermostUpstreams := make(map[string]bool)
+	for _, file := range parsed {
+		for _, upstream := range findNginxDirectives(httpLevel[file.Path], "upstream") {
+			if len(upstream.Args) == 0 {
+				continue
+			}
+			for _, server := range findNginxDirectives(upstream.Children, "server") {
+				if len(server.Args) > 0 && targetsPort(server.Args[0], config.ListenPort) {
+					mattermostUpstreams[upstream.Args[0]] = true
+				}
+			}
+		}
+	}
+
+	found := false
+	for _, file := range parsed {
+		for _, server := range findNginxDirectives(httpLevel[file.Path], "server") {
+			if !server.Block {
+				continue
+			}
+
+			var mattermostLocations []*nginxDirective
+			for _, location := range findNginxLocations(server.Children) {
+				for _, proxyPass := range findNginxDirectives(location.Children, "proxy_pass") {
+					if len(proxyPass.Args) == 0 {
+						continue
+					}
+					host := proxyTargetHost(proxyPass.Args[0])
+					if targetsPort(host, config.ListenPort) || mattermostUpstreams[host] {
+						mattermostLocations = append(mattermostLocations, location)
+						break
+					}
+				}
+			}
+			if len(mattermostLocations) == 0 {
+				continue
+			}
+			found = true
+
+			serverName := "(no server_name)"
+			if names := findNginxDirectives(server.Children, "server_name"); len(names) > 0 {
+				serverName = strings.Join(names[0].Args, " ")
+			}
+
+			fmt.Fprintf(w, "\nServer block proxying to Mattermost in %s (server_name %s):\n\n", file.Path, serverName)
+			fmt.Fprintf(w, "%s\n\n", server.Source[server.Start:server.End])
+
+			// The recommended Mattermost config uses a dedicated location for the websocket endpoint, so websocket
+			// support is checked across the server block rather than for every location
+			websocketSupport := false
+			websocketUnknown := false
+			outerLevels := [][]*nginxDirective{server.Children, httpLevel[file.Path], globalHTTPLevel}
+			for _, location := range mattermostLocations {
+				locationName := "location " + strings.Join(location.Args, " ")
+				levels := append([][]*nginxDirective{location.Children}, outerLevels...)
+
+				headers := effectiveNginxHeaders(levels)
+				upgrade := strings.Contains(headers["upgrade"], "$http_upgrade")
+				connection := strings.Contains(strings.ToLower(headers["connection"]), "upgrade")
+
+				httpVersion := "1.0"
+				if directive := effectiveNginxDirective(levels, "proxy_http_version"); directive != nil && len(directive.Args) > 0 {
+					httpVersion = directive.Args[0]
+				}
+
+				switch {
+				case upgrade && connection && httpVersion == "1.1":
+					fmt.Fprintf(w, "  %s: websocket upgrade headers present\n", locationName)
+					websocketSupport = true
+				case upgrade && connection:
+					fmt.Fprintf(w, "  %s: websocket upgrade headers present, but proxy_http_version is %s - websockets require 1.1\n", locationName, httpVersion)
+				case len(findNginxDirectives(location.Children, "include")) > 0 || len(findNginxDirectives(server.Children, "include")) > 0:
+					fmt.Fprintf(w, "  %s: no websocket upgrade headers found, but the block has an include that couldn't be read\n", locationName)
+					websocketUnknown = true
+				default:
+					fmt.Fprintf(w, "  %s: no websocket upgrade headers\n", locationName)
+				}
+
+				bodySize := "1m"
+				if directive := effectiveNginxDirective(levels, "client_max_body_size"); directive != nil && len(directive.Args) > 0 {
+					bodySize = directive.Args[0]
+				}
+				bodyBytes, err := parseNginxSize(bodySize)
+				switch {
+				case err != nil:
+					fmt.Fprintf(w, "  %s: unable to parse client_max_body_size %s\n", locationName, bodySize)
+				case bodyBytes == 0:
+					fmt.Fprintf(w, "  %s: client_max_body_size is unlimited\n", locationName)
+				case bodyBytes < config.MaxFileSize:
+					fmt.Fprintf(w, "  %s: client_max_body_size %s (%s) is SMALLER than FileSettings.MaxFileSize (%s)\n", locationName, bodySize, formatBytes(bodyBytes), formatBytes(config.MaxFileSize))
+					AddSummaryFinding(warningLevel, reverseProxyArea, fmt.Sprintf("nginx %s (%s) client_max_body_size %s is smaller than FileSettings.MaxFileSize (%s) - large uploads will fail", locationName, serverName, bodySize, formatBytes(config.MaxFileSize)))
+				default:
+					fmt.Fprintf(w, "  %s: client_max_body_size %s is sufficient for FileSettings.MaxFileSize (%s)\n", locationName, bodySize, formatBytes(config.MaxFileSize))
+				}
+			}
+
+			if !websocketSupport && websocketUnknown {
+				fmt.Fprintf(w, "  NOTE: Websocket support couldn't be confirmed, as an included file couldn't be read\n")
+			} else if !websocketSupport {
+				fmt.Fprintf(w, "  WARNING: No location passes websocket connections to Mattermost (proxy_set_header Upgrade $http_upgrade, Connection \"upgrade\" and proxy_http_version 1.1)\n")
+				AddSummaryFinding(warningLevel, reverseProxyArea, "nginx server "+serverName+" does not proxy websocket connections to Mattermost (Upgrade/Connection headers and proxy_http_version 1.1 are required)")
+			}
+		}
+	}
+
+	if !found {
+		fmt.Fprintf(w, "\nNo server blocks proxying to port %s were found.\n", config.ListenPort)
+		AddSummaryFinding(infoLevel, reverseProxyArea, "nginx configuration found, but no server block proxies to port "+config.ListenPort)
+	}
+	fmt.Fprintf(w, "\n")
+
+	var includedFiles []string
+	for path := range included {
+		includedFiles = append(includedFiles, path)
+	}
+	sort.Strings(includedFiles)
+	return includedFiles
+}
+
+// analyseApache finds the Apache virtual hosts that proxy to Mattermost and checks that websockets are proxied and
+// that LimitRequestBody allows uploads of FileSettings.MaxFileSize.
+func analyseApache(w io.Writer, files []string, config *mmConfig) {
+	fmt.Fprintf(w, "Apache\n======\n")
+
+	proxyPattern := regexp.MustCompile(`(?i)^\s*(ProxyPass|ProxyPassMatch|ProxyPassReverse|RewriteRule)\b.*(https?|wss?)://[^\s/]+:` + regexp.QuoteMeta(config.ListenPort) + `\b`)
+	websocketPattern := regexp.MustCompile(`(?i)(wss?://[^\s/]+:` + regexp.QuoteMeta(config.ListenPort) + `\b|upgrade=websocket|%\{HTTP:Upgrade\}\s+websocket)`)
+	limitPattern := regexp.MustCompile(`(?i)^\s*LimitRequestBody\s+(\d+)`)
+
+	globalLimit := int64(-1)
+	found := false
+
+	for _, path := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(w, "Unable to read %s: %s\n", path, err.Error())
+			continue
+		}
+
+		var vhost []string
+		inVhost := false
+		for _, line := range strings.Split(string(content), "\n") {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			lower := strings.ToLower(trimmed)
+
+			if strings.HasPrefix(lower, "<virtualhost") {
+				inVhost = true
+				vhost = []string{line}
+				continue
+			}
+			if inVhost {
+				vhost = append(vhost, line)
+				if strings.HasPrefix(lower, "</virtualhost") {
+					inVhost = false
+					if analyseApacheVhost(w, path, vhost, config, proxyPattern, websocketPattern, limitPattern) {
+						found = true
+					}
+				}
+				continue
+			}
+
+			if matches := limitPattern.FindStringSubmatch(line); matches != nil {
+				globalLimit, _ = strconv.ParseInt(matches[1], 10, 64)
+			}
+		}
+	}
+
+	if globalLimit > 0 && globalLimit < config.MaxFileSize {
+		fmt.Fprintf(w, "\nGlobal LimitRequestBody (%s) is SMALLER than FileSettings.MaxFileSize (%s)\n", formatBytes(globalLimit), formatBytes(config.MaxFileSize))
+		AddSummaryFinding(warningLevel, reverseProxyArea, fmt.Sprintf("Apache global LimitRequestBody (%s) is smaller than FileSettings.MaxFileSize (%s)", formatBytes(globalLimit), formatBytes(config.MaxFileSize)))
+	}
+
+	if !found {
+		fmt.Fprintf(w, "\nNo virtual hosts proxying to port %s were found.\n", config.ListenPort)
+		AddSummaryFinding(infoLevel, reverseProxyArea, "Apache configuration found, but no virtual host proxies to port "+config.ListenPort)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// analyseApacheVhost checks a single virtual host, returning true if it proxies to Mattermost
+func analyseApacheVhost(w io.Writer, path string, vhost []string, config *mmConfig, proxyPattern, websocketPattern, limitPattern *regexp.Regexp) bool {
+	proxies := false
+	websockets := false
+	limit := int64(-1)
+	serverName := "(no ServerName)"
+
+	for _, line := range vhost {
+		if proxyPattern.MatchString(line) {
+			proxies = true
+		}
+		if websocketPattern.MatchString(line) {
+			websockets = true
+		}
+		if matches := limitPattern.FindStringSubmatch(line); matches != nil {
+			limit, _ = strconv.ParseInt(matches[1], 10, 64)
+		}
+		if fields := strings.Fields(line); len(fields) > 1 && strings.EqualFold(fields[0], "ServerName") {
+			serverName = fields[1]
+		}
+	}
+	if !proxies {
+		return false
+	}
+
+	fmt.Fprintf(w, "\nVirtual host proxying to Mattermost in %s (ServerName %s):\n\n", path, serverName)
+	fmt.Fprintf(w, "%s\n\n", strings.Join(vhost, "\n"))
+
+	if websockets {
+		fmt.Fprintf(w, "  Websocket proxying configured\n")
+	} else {
+		fmt.Fprintf(w, "  MISSING websocket proxying (ws:// ProxyPass or RewriteRule on the Upgrade header)\n")
+		AddSummaryFinding(warningLevel, reverseProxyArea, "Apache virtual host "+serverName+" does not proxy websockets to Mattermost")
+	}
+
+	switch {
+	case limit == -1:
+		fmt.Fprintf(w, "  LimitRequestBody not set in this virtual host (Apache 2.4.54+ defaults to 1 GiB)\n")
+	case limit == 0:
+		fmt.Fprintf(w, "  LimitRequestBody is unlimited\n")
+	case limit < config.MaxFileSize:
+		fmt.Fprintf(w, "  LimitRequestBody (%s) is SMALLER than FileSettings.MaxFileSize (%s)\n", formatBytes(limit), formatBytes(config.MaxFileSize))
+		AddSummaryFinding(warningLevel, reverseProxyArea, fmt.Sprintf("Apache virtual host %s LimitRequestBody (%s) is smaller than FileSettings.MaxFileSize (%s)", serverName, formatBytes(limit), formatBytes(config.MaxFileSize)))
+	default:
+		fmt.Fprintf(w, "  LimitRequestBody (%s) is sufficient for FileSettings.MaxFileSize (%s)\n", formatBytes(limit), formatBytes(config.MaxFileSize))
+	}
+
+	return true
+}
+
+// analyseHAProxy finds the HAProxy backends that route to Mattermost (and the frontends that use them), and checks
+// that a tunnel timeout is set so that idle websocket connections aren't dropped after "timeout server".
+func analyseHAProxy(w io.Writer, files []string, config *mmConfig) {
+	fmt.Fprintf(w, "HAProxy\n=======\n")
+
+	sectionKeywords := map[string]bool{"global": true, "defaults": true, "frontend": true, "backend": true, "listen": true,
+		"userlist": true, "peers": true, "resolvers": true, "mailers": true, "program": true, "cache": true, "ring": true}
+
+	type haproxySection struct {
+		Keyword string
+		Name    string
+		Lines   []string
+	}
+
+	found := false
+	for _, path := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(w, "Unable to read %s: %s\n", path, err.Error())
+			continue
+		}
+
+		var sections []*haproxySection
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && sectionKeywords[fields[0]] {
+				section := &haproxySection{Keyword: fields[0], Lines: []string{line}}
+				if len(fields) > 1 {
+					section.Name = fields[1]
+				}
+				sections = append(sections, section)
+				continue
+			}
+			if len(sections) > 0 {
+				sections[len(sections)-1].Lines = append(sections[len(sections)-1].Lines, line)
+			}
+		}
+
+		tunnelTimeoutDefault := false
+		mattermostBackends := make(map[string]bool)
+		for _, section := range sections {
+			for _, line := range section.Lines {
+				fields := strings.Fields(line)
+				if section.Keyword == "defaults" && len(fields) > 1 && fields[0] == "timeout" && fields[1] == "tunnel" {
+					tunnelTimeoutDefault = true
+				}
+				if (section.Keyword == "backend" || section.Keyword == "listen") && len(fields) > 2 && fields[0] == "server" && targetsPort(fields[2], config.ListenPort) {
+					mattermostBackends[section.Name] = true
+				}
+			}
+		}
+
+		for _, section := range sections {
+			relevant := mattermostBackends[section.Name] && (section.Keyword == "backend" || section.Keyword == "listen")
+			if section.Keyword == "frontend" {
+				for _, line := range section.Lines {
+					fields := strings.Fields(line)
+					if len(fields) > 1 && (fields[0] == "default_backend" || fields[0] == "use_backend") && mattermostBackends[fields[1]] {
+						relevant = true
+					}
+				}
+			}
+			if !relevant {
+				continue
+			}
+			found = true
+
+			fmt.Fprintf(w, "\n%s %s in %s:\n\n%s\n\n", section.Keyword, section.Name, path, strings.Join(section.Lines, "\n"))
+
+			if section.Keyword == "frontend" {
+				continue
+			}
+			tunnelTimeout := tunnelTimeoutDefault
+			for _, line := range section.Lines {
+				fields := strings.Fields(line)
+				if len(fields) > 1 && fields[0] == "timeout" && fields[1] == "tunnel" {
+					tunnelTimeout = true
+				}
+			}
+			if tunnelTimeout {
+				fmt.Fprintf(w, "  timeout tunnel is set - websocket connections will be kept open\n")
+			} else {
+				fmt.Fprintf(w, "  timeout tunnel is NOT set - idle websocket connections will be closed after 'timeout server'\n")
+				AddSummaryFinding(warningLevel, reverseProxyArea, "HAProxy "+section.Keyword+" "+section.Name+" has no 'timeout tunnel' - idle websocket connections will be dropped")
+			}
+		}
+	}
+
+	if !found {
+		fmt.Fprintf(w, "\nNo backends routing to port %s were found.\n", config.ListenPort)
+		AddSummaryFinding(infoLevel, reverseProxyArea, "HAProxy configuration found, but no backend routes to port "+config.ListenPort)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// CollectReverseProxyConfig discovers nginx, Apache and HAProxy configuration on the host, captures the config files
+// and analyses the parts that proxy to the Mattermost ListenPort.  Misconfigurations (missing websocket support,
+// upload size limits below FileSettings.MaxFileSize, etc.) are reported in the summary.
+// The function takes the parsed config and the temp directory as parameters, and returns an error object (nil on success).
+// The config files are copied into the reverse-proxy directory, and the analysis is written to reverse-proxy/analysis.txt.
+func CollectReverseProxyConfig(config *mmConfig, targetDir string) error {
+	DebugPrint("Collecting reverse proxy configuration - writing to: " + targetDir)
+
+	nginxFiles := discoverConfigFiles(nginxConfigPaths)
+	apacheFiles := discoverConfigFiles(apacheConfigPaths)
+	haproxyFiles := discoverConfigFiles(haproxyConfigPaths)
+
+	if len(nginxFiles) == 0 && len(apacheFiles) == 0 && len(haproxyFiles) == 0 {
+		LogMessage(infoLevel, "No reverse proxy configuration found")
+		AddSummaryFinding(infoLevel, reverseProxyArea, "No nginx, Apache or HAProxy configuration found on this host")
+		return nil
+	}
+
+	proxyDir := targetDir + "/reverse-proxy"
+	if err := os.MkdirAll(proxyDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+proxyDir)
+		return errors.New(err.Error())
+	}
+
+	file, err := os.Create(proxyDir + "/analysis.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for reverse proxy analysis in "+proxyDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "Reverse Proxy Analysis\n")
+	fmt.Fprintf(file, "Mattermost ListenPort: %s\n", config.ListenPort)
+	fmt.Fprintf(file, "FileSettings.MaxFileSize: %s\n\n", formatBytes(config.MaxFileSize))
+
+	if len(nginxFiles) > 0 {
+		includedFiles := analyseNginx(file, nginxFiles, config)
+		captureConfigFiles(append(nginxFiles, includedFiles...), proxyDir+"/nginx")
+	}
+	if len(apacheFiles) > 0 {
+		captureConfigFiles(apacheFiles, proxyDir+"/apache")
+		analyseApache(file, apacheFiles, config)
+	}
+	if len(haproxyFiles) > 0 {
+		captureConfigFiles(haproxyFiles, proxyDir+"/haproxy")
+		analyseHAProxy(file, haproxyFiles, config)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeNginxConfig writes an nginx config tree into a temporary directory, returning the path of nginx.conf
+func writeNginxConfig(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	return filepath.Join(dir, "nginx.conf")
+}
+
+func TestAnalyseNginxFollowsIncludes(t *testing.T) {
+	const mainConfig = `http {
+    server {
+        listen 443 ssl;
+        server_name chat.example.com;
+        location ~ /api/v[0-9]+/(users/)?websocket$ {
+            proxy_pass http://127.0.0.1:8065;
+            include %s;
+        }
+    }
+}
+`
+	const snippet = `proxy_set_header Upgrade $http_upgrade;
+proxy_set_header Connection "upgrade";
+proxy_http_version 1.1;
+`
+
+	tests := []struct {
+		name         string
+		include      string
+		files        map[string]string
+		expected     string
+		wantWarning  bool
+		wantIncluded int
+	}{
+		{
+			name:         "relative include",
+			include:      "snippets/mattermost-proxy.conf",
+			files:        map[string]string{"snippets/mattermost-proxy.conf": snippet},
+			expected:     "websocket upgrade headers present",
+			wantIncluded: 1,
+		},
+		{
+			name:         "glob include",
+			include:      "snippets/*.conf",
+			files:        map[string]string{"snippets/mattermost-proxy.conf": snippet},
+			expected:     "websocket upgrade headers present",
+			wantIncluded: 1,
+		},
+		{
+			name:     "missing include",
+			include:  "snippets/missing.conf",
+			expected: "an include that couldn't be read",
+		},
+		{
+			name:         "include without the headers",
+			include:      "snippets/other.conf",
+			files:        map[string]string{"snippets/other.conf": "proxy_read_timeout 600s;\n"},
+			expected:     "no websocket upgrade headers",
+			wantWarning:  true,
+			wantIncluded: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := map[string]string{"nginx.conf": fmt.Sprintf(mainConfig, test.include)}
+			for name, content := range test.files {
+				files[name] = content
+			}
+			nginxConf := writeNginxConfig(t, files)
+
+			summaryFindings = nil
+			t.Cleanup(func() { summaryFindings = nil })
+
+			var output bytes.Buffer
+			included := analyseNginx(&output, []string{nginxConf}, &mmConfig{ListenPort: "8065", MaxFileSize: 1024})
+			if !strings.Contains(output.String(), test.expected) {
+				t.Errorf("output doesn't contain %q:\n%s", test.expected, output.String())
+			}
+			if len(included) != test.wantIncluded {
+				t.Errorf("included files = %v, want %d", included, test.wantIncluded)
+			}
+
+			warned := false
+			for _, finding := range summaryFindings {
+				if strings.Contains(finding.Message, "websocket") {
+					warned = true
+				}
+			}
+			if warned != test.wantWarning {
+				t.Errorf("websocket finding = %v, want %v (findings: %v)", warned, test.wantWarning, summaryFindings)
+			}
+		})
+	}
+}
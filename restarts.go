@@ -0,0 +1,356 @@
+// Package main contains the crash-loop and restart history analysis for the Mattermost systemd unit
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// restartsArea is the area name used for summary findings from the restart history analysis
+const restartsArea = "Restart History"
+
+// maxTimelineEvents limits the number of events written to the timeline.  A service in a tight restart loop can
+// generate thousands of events, and the most recent ones are the most relevant.
+const maxTimelineEvents = 500
+
+// Patterns for the messages systemd logs about the lifecycle of a unit
+var (
+	unitStartingPattern    = regexp.MustCompile(`^Starting `)
+	unitStartedPattern     = regexp.MustCompile(`^Started `)
+	unitStoppingPattern    = regexp.MustCompile(`^Stopping `)
+	unitStoppedPattern     = regexp.MustCompile(`^Stopped `)
+	unitMainExitPattern    = regexp.MustCompile(`Main process exited, code=(\w+), status=(\d+)(?:/(\w+))?`)
+	unitFailedPattern      = regexp.MustCompile(`Failed with result '([\w-]+)'`)
+	unitRestartPattern     = regexp.MustCompile(`Scheduled restart job, restart counter is at (\d+)`)
+	unitStartLimitPattern  = regexp.MustCompile(`Start request repeated too quickly`)
+	unitOOMPattern         = regexp.MustCompile(`killed by the OOM killer`)
+	kernelOOMKillPattern   = regexp.MustCompile(`(?i)killed process \d+ \(mattermost\)`)
+	mattermostConfigErrors = regexp.MustCompile(`(?i)(failed to load config|error loading config|failed to initiali[sz]e config|invalid config|failed to (read|parse|validate) config|unable to load config|config.*is invalid)`)
+)
+
+// restartEvent is a single event in the restart timeline
+type restartEvent struct {
+	Time        time.Time
+	Description string
+}
+
+// restartAnalysis holds the evidence gathered about why the service stopped or restarted
+type restartAnalysis struct {
+	Events        []restartEvent
+	OOMKilled     bool
+	Segfaulted    bool
+	ConfigError   string
+	StartLimitHit bool
+	Results       map[string]int
+	ExitStatuses  map[string]int
+}
+
+// journalEntryMessage extracts the MESSAGE field from a journal JSON entry.  journalctl encodes messages that aren't
+// valid UTF-8 as an array of bytes, rather than a string.
+func journalEntryMessage(entry map[string]interface{}) string {
+	switch message := entry["MESSAGE"].(type) {
+	case string:
+		return message
+	case []interface{}:
+		var buffer bytes.Buffer
+		for _, b := range message {
+			if value, ok := b.(float64); ok {
+				buffer.WriteByte(byte(value))
+			}
+		}
+		return buffer.String()
+	}
+	return ""
+}
+
+// journalEntryTime extracts the timestamp of a journal JSON entry
+func journalEntryTime(entry map[string]interface{}) time.Time {
+	if value, ok := entry["__REALTIME_TIMESTAMP"].(string); ok {
+		if usec, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.UnixMicro(usec)
+		}
+	}
+	return time.Time{}
+}
+
+// describeExitStatus converts the systemd ExecMainCode/ExecMainStatus pair into a readable description.  The code
+// follows the waitid() si_code values: 1 = exited, 2 = killed by a signal, 3 = killed by a signal and dumped core.
+func describeExitStatus(code string, status string) string {
+	switch code {
+	case "1":
+		return "exited with status " + status
+	case "2":
+		return "killed by signal " + status
+	case "3":
+		return "killed by signal " + status + " (core dumped)"
+	case "0", "":
+		return "no exit recorded"
+	}
+	return "code " + code + ", status " + status
+}
+
+// scanJournalJSON runs journalctl in JSON format, passing each entry to the handler as it's read.  The output is
+// streamed rather than buffered, as the journal for a long-lived service can be very large.
+func scanJournalJSON(args []string, handle func(entry map[string]interface{})) error {
+	cmd := exec.Command("journalctl", append(args, "-o", "json", "--no-pager")...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.New(err.Error())
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		handle(entry)
+	}
+
+	// If the scanner gave up (e.g. on an oversized entry), drain the rest so journalctl isn't blocked writing to us
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil {
+		return errors.New(err.Error())
+	}
+	if scanErr != nil {
+		return errors.New(scanErr.Error())
+	}
+	return nil
+}
+
+// scanJournalBoots runs scanJournalJSON for each of the boots we collect the journal for, oldest first, so that the
+// analysis covers the same window as the journal/ files.  There won't be a previous boot if the journal isn't
+// persistent, so only a failure to read the current boot is returned.
+func scanJournalBoots(args []string, options journalOptions, handle func(entry map[string]interface{})) error {
+	for i := len(journalBoots) - 1; i >= 0; i-- {
+		boot := journalBoots[i]
+		bootArgs := append(append([]string{"-b", boot.Offset}, args...), journalTimeArgs(options)...)
+		if err := scanJournalJSON(bootArgs, handle); err != nil {
+			if boot.Offset == "0" {
+				return err
+			}
+			DebugPrint("No journal available for the " + boot.Name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// analyseUnitJournal reads the journal for the unit in JSON format, building a timeline of lifecycle events and
+// gathering evidence of OOM kills, crashes and configuration errors.
+func analyseUnitJournal(serviceName string, options journalOptions, analysis *restartAnalysis) error {
+	return scanJournalBoots([]string{"-u", serviceName}, options, func(entry map[string]interface{}) {
+		message := journalEntryMessage(entry)
+		timestamp := journalEntryTime(entry)
+
+		// Messages from Mattermost itself are only of interest if they point to a configuration problem
+		if identifier, _ := entry["SYSLOG_IDENTIFIER"].(string); identifier != "systemd" {
+			if mattermostConfigErrors.MatchString(message) {
+				analysis.ConfigError = message
+			}
+			return
+		}
+
+		var description string
+		switch {
+		case unitMainExitPattern.MatchString(message):
+			matches := unitMainExitPattern.FindStringSubmatch(message)
+			code, status, name := matches[1], matches[2], matches[3]
+			description = "EXITED code=" + code + " status=" + status
+			if name != "" {
+				description += "/" + name
+			}
+			analysis.ExitStatuses[code+" "+status+"/"+name]++
+			if code == "dumped" || name == "SEGV" || (code == "killed" && status == "11") {
+				analysis.Segfaulted = true
+			}
+		case unitFailedPattern.MatchString(message):
+			result := unitFailedPattern.FindStringSubmatch(message)[1]
+			description = "FAILED result=" + result
+			analysis.Results[result]++
+			if result == "oom-kill" {
+				analysis.OOMKilled = true
+			}
+			if result == "core-dump" {
+				analysis.Segfaulted = true
+			}
+		case unitRestartPattern.MatchString(message):
+			description = "RESTART SCHEDULED (counter " + unitRestartPattern.FindStringSubmatch(message)[1] + ")"
+		case unitStartLimitPattern.MatchString(message):
+			description = "START LIMIT HIT - systemd has stopped restarting the service"
+			analysis.StartLimitHit = true
+		case unitOOMPattern.MatchString(message):
+			description = "OOM KILLED"
+			analysis.OOMKilled = true
+		case unitStartingPattern.MatchString(message):
+			description = "STARTING"
+		case unitStartedPattern.MatchString(message):
+			description = "STARTED"
+		case unitStoppingPattern.MatchString(message):
+			description = "STOPPING"
+		case unitStoppedPattern.MatchString(message):
+			description = "STOPPED"
+		default:
+			return
+		}
+
+		analysis.Events = append(analysis.Events, restartEvent{Time: timestamp, Description: description})
+	})
+}
+
+// checkKernelOOMKills looks in the kernel log for the OOM killer choosing a mattermost process
+func checkKernelOOMKills(options journalOptions, analysis *restartAnalysis) {
+	err := scanJournalBoots([]string{"-k"}, options, func(entry map[string]interface{}) {
+		if message := journalEntryMessage(entry); kernelOOMKillPattern.MatchString(message) {
+			analysis.OOMKilled = true
+			analysis.Events = append(analysis.Events, restartEvent{Time: journalEntryTime(entry), Description: "KERNEL OOM KILLER: " + message})
+		}
+	})
+	if err != nil {
+		DebugPrint("Unable to read kernel log for OOM kills: " + err.Error())
+	}
+}
+
+// writeCounts writes a map of counts in a stable (sorted) order
+func writeCounts(w io.Writer, counts map[string]int) {
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s: %d\n", key, counts[key])
+	}
+}
+
+// writeRestartReport writes the current unit state, the diagnosis and the timeline of events
+func writeRestartReport(w io.Writer, serviceName string, properties map[string]string, analysis *restartAnalysis) {
+	fmt.Fprintf(w, "Restart History for %s\n", serviceName)
+	fmt.Fprintf(w, "%s\n\n", strings.Repeat("=", len("Restart History for ")+len(serviceName)))
+
+	fmt.Fprintf(w, "Current State:       %s (%s)\n", properties["ActiveState"], properties["SubState"])
+	fmt.Fprintf(w, "Result:              %s\n", properties["Result"])
+	fmt.Fprintf(w, "NRestarts:           %s\n", properties["NRestarts"])
+	fmt.Fprintf(w, "Last Main Process:   %s\n", describeExitStatus(properties["ExecMainCode"], properties["ExecMainStatus"]))
+	fmt.Fprintf(w, "Last Started:        %s\n", properties["ExecMainStartTimestamp"])
+	fmt.Fprintf(w, "Last Exited:         %s\n", properties["ExecMainExitTimestamp"])
+	fmt.Fprintf(w, "Restart Policy:      Restart=%s RestartUSec=%s\n", properties["Restart"], properties["RestartUSec"])
+	fmt.Fprintf(w, "Start Limit:         StartLimitBurst=%s StartLimitIntervalUSec=%s\n", properties["StartLimitBurst"], properties["StartLimitIntervalUSec"])
+
+	fmt.Fprintf(w, "\nDiagnosis\n---------\n")
+	diagnosed := false
+	if analysis.OOMKilled {
+		fmt.Fprintf(w, "- The Mattermost process was killed by the OOM killer\n")
+		diagnosed = true
+	}
+	if analysis.Segfaulted {
+		fmt.Fprintf(w, "- The Mattermost process crashed (segmentation fault or core dump)\n")
+		diagnosed = true
+	}
+	if analysis.ConfigError != "" {
+		fmt.Fprintf(w, "- Mattermost reported a configuration error: %s\n", analysis.ConfigError)
+		diagnosed = true
+	}
+	if analysis.StartLimitHit {
+		fmt.Fprintf(w, "- systemd gave up restarting the service after hitting the start limit\n")
+		diagnosed = true
+	}
+	if !diagnosed {
+		fmt.Fprintf(w, "- No OOM kills, crashes or configuration errors were identified\n")
+	}
+
+	if len(analysis.ExitStatuses) > 0 {
+		fmt.Fprintf(w, "\nExit Statuses (code status/name: count)\n")
+		writeCounts(w, analysis.ExitStatuses)
+	}
+	if len(analysis.Results) > 0 {
+		fmt.Fprintf(w, "\nFailure Results (result: count)\n")
+		writeCounts(w, analysis.Results)
+	}
+
+	events := analysis.Events
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	fmt.Fprintf(w, "\nTimeline (%d events", len(events))
+	if len(events) > maxTimelineEvents {
+		events = events[len(events)-maxTimelineEvents:]
+		fmt.Fprintf(w, ", showing the most recent %d", maxTimelineEvents)
+	}
+	fmt.Fprintf(w, ")\n--------\n")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s  %s\n", event.Time.Format("2006-01-02 15:04:05.000 -0700"), event.Description)
+	}
+}
+
+// AnalyseRestartHistory determines whether the Mattermost service is crash-looping, and why.  It combines the unit's
+// restart counters and last exit status from systemd with a timeline of start/stop/exit events built from the
+// journal, and reports whether the process was OOM-killed, crashed, or exited because of a configuration error.
+// The name of the service, the journal options and the temp directory are passed in as parameters, and the
+// function returns an error object (nil on success).
+// The report is written to systemd/restart-history.txt.
+func AnalyseRestartHistory(serviceName string, options journalOptions, targetDir string) error {
+	DebugPrint("Analysing restart history for " + serviceName + " - writing to: " + targetDir)
+
+	systemdDir := targetDir + "/systemd"
+	if err := os.MkdirAll(systemdDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+systemdDir)
+		return errors.New(err.Error())
+	}
+
+	properties, err := getSystemdProperties(serviceName, "ActiveState", "SubState", "Result", "NRestarts",
+		"ExecMainCode", "ExecMainStatus", "ExecMainStartTimestamp", "ExecMainExitTimestamp",
+		"Restart", "RestartUSec", "StartLimitBurst", "StartLimitIntervalUSec")
+	if err != nil {
+		LogMessage(warningLevel, "Failed to get unit properties from systemctl")
+		return err
+	}
+
+	analysis := &restartAnalysis{Results: make(map[string]int), ExitStatuses: make(map[string]int)}
+	if err := analyseUnitJournal(serviceName, options, analysis); err != nil {
+		LogMessage(warningLevel, "Failed to read the journal for "+serviceName+": "+err.Error())
+	}
+	checkKernelOOMKills(options, analysis)
+
+	file, err := os.Create(systemdDir + "/restart-history.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for restart history in "+systemdDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	writeRestartReport(file, serviceName, properties, analysis)
+
+	if restarts, err := strconv.Atoi(properties["NRestarts"]); err == nil && restarts > 0 {
+		AddSummaryFinding(warningLevel, restartsArea, fmt.Sprintf("%s has been restarted %d times by systemd", serviceName, restarts))
+	}
+	if analysis.OOMKilled {
+		AddSummaryFinding(errorLevel, restartsArea, "Mattermost was killed by the OOM killer")
+	}
+	if analysis.Segfaulted {
+		AddSummaryFinding(errorLevel, restartsArea, "Mattermost crashed with a segmentation fault or core dump")
+	}
+	if analysis.ConfigError != "" {
+		AddSummaryFinding(errorLevel, restartsArea, "Mattermost exited because of a configuration error: "+analysis.ConfigError)
+	}
+	if analysis.StartLimitHit {
+		AddSummaryFinding(errorLevel, restartsArea, "systemd stopped restarting "+serviceName+" after hitting the start limit - run 'systemctl reset-failed "+serviceName+"' once the cause is fixed")
+	}
+
+	return nil
+}
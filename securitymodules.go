@@ -0,0 +1,251 @@
+// Package main contains the Linux security module collector, which records the state of SELinux and AppArmor
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// securityArea is the area name used for summary findings relating to SELinux and AppArmor
+const securityArea = "SELinux/AppArmor"
+
+const (
+	// selinuxFS is where the kernel exposes the SELinux state.  The directory can exist even when SELinux is disabled,
+	// so we check for the files within it.
+	selinuxFS = "/sys/fs/selinux"
+	// maxDenialLines limits how many denials we record, keeping the most recent
+	maxDenialLines = 500
+)
+
+// selinuxBooleans are the SELinux booleans that affect Mattermost and the reverse proxy in front of it.  Without
+// httpd_can_network_connect, nginx and Apache can't connect to Mattermost's ListenPort.
+var selinuxBooleans = []string{"httpd_can_network_connect", "httpd_can_network_relay", "httpd_can_network_connect_db"}
+
+// auditLogPaths are the audit logs searched for SELinux denials, oldest first
+var auditLogPaths = []string{"/var/log/audit/audit.log.1", "/var/log/audit/audit.log"}
+
+// kernelLogPaths are the logs searched for AppArmor denials, which are logged by the kernel (and by auditd, if it's
+// running)
+var kernelLogPaths = []string{"/var/log/kern.log", "/var/log/syslog", "/var/log/messages", "/var/log/audit/audit.log"}
+
+// readTrimmedFile returns the contents of a small file, such as a sysfs attribute, without surrounding whitespace
+func readTrimmedFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(string(content), "\x00")), nil
+}
+
+// collectMatchingLines returns the most recent lines from the given logs that satisfy the match function, keeping at
+// most maxDenialLines.  The logs are read in order, so older logs should come first.
+func collectMatchingLines(paths []string, match func(string) bool) []string {
+	var lines []string
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if match(scanner.Text()) {
+				lines = append(lines, scanner.Text())
+				if len(lines) > maxDenialLines {
+					lines = lines[1:]
+				}
+			}
+		}
+		file.Close()
+	}
+	return lines
+}
+
+// portInRanges reports whether a port appears in a comma-separated list of ports and ranges, as printed by
+// `semanage port -l`, e.g. "80, 81, 443, 8008-8009"
+func portInRanges(port int, ranges string) bool {
+	for _, item := range strings.Split(ranges, ",") {
+		low, high, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		first, err := strconv.Atoi(low)
+		if err != nil {
+			continue
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(high); err != nil {
+				continue
+			}
+		}
+		if port >= first && port <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSELinuxPortLabels records which SELinux port types include the ListenPort, using `semanage port -l`
+func writeSELinuxPortLabels(w io.Writer, listenPort string) {
+	port, err := strconv.Atoi(listenPort)
+	if err != nil {
+		return
+	}
+	if !commandExists("semanage") {
+		fmt.Fprintf(w, "Port Labels:     semanage not installed (policycoreutils-python-utils)\n")
+		return
+	}
+
+	output, err := exec.Command("semanage", "port", "-l").Output()
+	if err != nil {
+		fmt.Fprintf(w, "Port Labels:     semanage failed: %s\n", err.Error())
+		return
+	}
+
+	var labels []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "tcp" {
+			continue
+		}
+		if portInRanges(port, strings.Join(fields[2:], " ")) {
+			labels = append(labels, fields[0])
+		}
+	}
+	if len(labels) == 0 {
+		fmt.Fprintf(w, "Port Labels:     tcp/%d has no SELinux port type\n", port)
+	} else {
+		fmt.Fprintf(w, "Port Labels:     tcp/%d is labelled %s\n", port, strings.Join(labels, ", "))
+	}
+}
+
+// writeSELinuxStatus records the SELinux mode, policy, booleans, port labels and recent denials
+func writeSELinuxStatus(w io.Writer, listenPort string) {
+	fmt.Fprintf(w, "SELinux\n=======\n")
+
+	enforce, err := readTrimmedFile(selinuxFS + "/enforce")
+	if err != nil {
+		fmt.Fprintf(w, "SELinux is not enabled\n")
+		return
+	}
+
+	mode := "permissive"
+	if enforce == "1" {
+		mode = "enforcing"
+	}
+	fmt.Fprintf(w, "Current Mode:    %s\n", mode)
+	if policyVersion, err := readTrimmedFile(selinuxFS + "/policyvers"); err == nil {
+		fmt.Fprintf(w, "Policy Version:  %s\n", policyVersion)
+	}
+
+	// The configured mode and policy take effect at the next boot, so may differ from the current mode
+	if content, err := os.ReadFile("/etc/selinux/config"); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if name, value, found := strings.Cut(strings.TrimSpace(line), "="); found && (name == "SELINUX" || name == "SELINUXTYPE") {
+				fmt.Fprintf(w, "%-16s %s\n", name+":", value)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\nBooleans:\n")
+	for _, name := range selinuxBooleans {
+		// The file contains the current and pending values, e.g. "1 1"
+		value, err := readTrimmedFile(selinuxFS + "/booleans/" + name)
+		if err != nil {
+			continue
+		}
+		state := "off"
+		if strings.HasPrefix(value, "1") {
+			state = "on"
+		}
+		fmt.Fprintf(w, "  %-30s %s\n", name, state)
+		if name == "httpd_can_network_connect" && state == "off" && mode == "enforcing" {
+			AddSummaryFinding(warningLevel, securityArea, "SELinux is enforcing and httpd_can_network_connect is off - nginx or Apache won't be able to proxy to Mattermost")
+		}
+	}
+	fmt.Fprintf(w, "\n")
+
+	writeSELinuxPortLabels(w, listenPort)
+
+	// Denials involving Mattermost itself, or a proxy connecting to the ListenPort
+	denials := collectMatchingLines(auditLogPaths, func(line string) bool {
+		return strings.Contains(line, "avc:") && strings.Contains(line, "denied") &&
+			(strings.Contains(strings.ToLower(line), "mattermost") || strings.Contains(line, "dest="+listenPort+" "))
+	})
+	fmt.Fprintf(w, "\nRecent AVC Denials (%d)\n", len(denials))
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", len("Recent AVC Denials ()")+len(strconv.Itoa(len(denials)))))
+	for _, denial := range denials {
+		fmt.Fprintf(w, "%s\n", denial)
+	}
+
+	switch {
+	case len(denials) > 0 && mode == "enforcing":
+		AddSummaryFinding(errorLevel, securityArea, fmt.Sprintf("SELinux is enforcing and has recorded %d denials involving Mattermost - see security-modules.txt", len(denials)))
+	case len(denials) > 0:
+		AddSummaryFinding(warningLevel, securityArea, fmt.Sprintf("SELinux is permissive, but has recorded %d denials involving Mattermost that would be enforced - see security-modules.txt", len(denials)))
+	default:
+		AddSummaryFinding(infoLevel, securityArea, "SELinux is "+mode)
+	}
+}
+
+// writeAppArmorStatus records whether AppArmor is enabled, the loaded profiles and recent denials
+func writeAppArmorStatus(w io.Writer) {
+	fmt.Fprintf(w, "\nAppArmor\n========\n")
+
+	if enabled, _ := readTrimmedFile("/sys/module/apparmor/parameters/enabled"); enabled != "Y" {
+		fmt.Fprintf(w, "AppArmor is not enabled\n")
+		return
+	}
+
+	// aa-status gives the best summary, but the kernel's own list of profiles is always available
+	if commandExists("aa-status") {
+		output, err := exec.Command("aa-status").CombinedOutput()
+		fmt.Fprintf(w, "%s\n", strings.TrimSpace(string(output)))
+		if err != nil {
+			fmt.Fprintf(w, "aa-status failed: %s\n", err.Error())
+		}
+	} else if profiles, err := os.ReadFile("/sys/kernel/security/apparmor/profiles"); err == nil {
+		fmt.Fprintf(w, "Loaded profiles:\n%s\n", strings.TrimSpace(string(profiles)))
+	}
+
+	denials := collectMatchingLines(kernelLogPaths, func(line string) bool {
+		return strings.Contains(line, `apparmor="DENIED"`) && strings.Contains(strings.ToLower(line), "mattermost")
+	})
+	fmt.Fprintf(w, "\nRecent AppArmor Denials (%d)\n", len(denials))
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", len("Recent AppArmor Denials ()")+len(strconv.Itoa(len(denials)))))
+	for _, denial := range denials {
+		fmt.Fprintf(w, "%s\n", denial)
+	}
+	if len(denials) > 0 {
+		AddSummaryFinding(errorLevel, securityArea, fmt.Sprintf("AppArmor has recorded %d denials involving Mattermost - see security-modules.txt", len(denials)))
+	}
+}
+
+// CollectSecurityModules records the state of the Linux security modules, which can silently stop Mattermost from
+// binding its port or reading its files.  For SELinux (RHEL-family hosts) we record the current and configured mode,
+// the policy, the booleans that allow a reverse proxy to connect to Mattermost (httpd_can_network_connect), the port
+// types the ListenPort is labelled with, and recent AVC denials from the audit log involving Mattermost or its
+// ListenPort.  For AppArmor (Ubuntu), we record the profile status and recent denials involving Mattermost.
+// The parsed config and the temp directory are passed as parameters, and the function returns an error object (nil on
+// success).
+// The result is written to security-modules.txt in the temp directory.
+func CollectSecurityModules(config *mmConfig, targetDir string) error {
+	DebugPrint("Collecting SELinux and AppArmor status - writing to: " + targetDir)
+
+	file, err := os.Create(targetDir + "/security-modules.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for security module information in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	writeSELinuxStatus(file, config.ListenPort)
+	writeAppArmorStatus(file)
+
+	return nil
+}
@@ -0,0 +1,340 @@
+// Package main contains the server API probes, which query a running (or partially running) Mattermost server
+package main
+
+import (
+	"archive/zip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// apiArea is the area name used for summary findings relating to the server API probes
+const apiArea = "Server API"
+
+const (
+	// apiRequestTimeout limits how long we'll wait for most API requests.  A degraded server may accept connections
+	// but never respond, and we don't want to hang with it.
+	apiRequestTimeout = 30 * time.Second
+	// supportPacketTimeout is longer, as the server gathers a lot of information to build its support packet
+	supportPacketTimeout = 5 * time.Minute
+	// apiLogsPerPage is the number of server log entries requested from /api/v4/logs
+	apiLogsPerPage = 10000
+)
+
+// apiClusterNode holds the fields we use from /api/v4/cluster/status
+type apiClusterNode struct {
+	ID         string `json:"id"`
+	Version    string `json:"version"`
+	ConfigHash string `json:"config_hash"`
+	IPAddress  string `json:"ipaddress"`
+	Hostname   string `json:"hostname"`
+}
+
+// serverAPIClient talks to the local Mattermost server's REST API, authenticating with a personal access token if one
+// was supplied
+type serverAPIClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// newServerAPIClient creates a client for the server listening on the local ListenPort.  If Mattermost terminates TLS
+// itself, the certificate won't match "localhost", so it isn't verified.
+func newServerAPIClient(config *mmConfig, token string) *serverAPIClient {
+	scheme := "http"
+	transport := &http.Transport{}
+	if strings.EqualFold(config.ConnectionSecurity, "TLS") {
+		scheme = "https"
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &serverAPIClient{
+		baseURL: scheme + "://" + net.JoinHostPort("127.0.0.1", config.ListenPort),
+		token:   token,
+		client:  &http.Client{Transport: transport},
+	}
+}
+
+// get performs a GET request against the API, returning the response body.  Any status other than 200 is returned as
+// an error, which explains the likely cause for authentication failures.
+func (c *serverAPIClient) get(path string, timeout time.Duration) (io.ReadCloser, error) {
+	DebugPrint("Querying server API: " + path)
+
+	request, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	client := *c.client
+	client.Timeout = timeout
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.Body, nil
+	case http.StatusUnauthorized:
+		response.Body.Close()
+		return nil, errors.New(path + " returned " + response.Status + " - the access token was rejected")
+	case http.StatusForbidden:
+		response.Body.Close()
+		return nil, errors.New(path + " returned " + response.Status + " - the access token needs the manage_system permission")
+	default:
+		response.Body.Close()
+		return nil, errors.New(path + " returned " + response.Status)
+	}
+}
+
+// saveToFile performs a GET request against the API, writing the response to the given file
+func (c *serverAPIClient) saveToFile(path string, timeout time.Duration, outputFile string) error {
+	body, err := c.get(path, timeout)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, body)
+	return err
+}
+
+// probeServerPing queries the ping endpoint, which reports the health of the database and file store as well as the
+// server itself, and writes the response to ping.json
+func probeServerPing(client *serverAPIClient, apiDir string) error {
+	body, err := client.get("/api/v4/system/ping?get_server_status=true", apiRequestTimeout)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(apiDir+"/ping.json", content, 0644); err != nil {
+		return err
+	}
+
+	var status map[string]interface{}
+	if err := json.Unmarshal(content, &status); err != nil {
+		return err
+	}
+
+	for _, check := range []struct {
+		Key  string
+		Name string
+	}{
+		{"status", "The server"},
+		{"database_status", "The database"},
+		{"filestore_status", "The file store"},
+	} {
+		value, ok := status[check.Key].(string)
+		if !ok {
+			continue
+		}
+		if value == "OK" {
+			AddSummaryFinding(infoLevel, apiArea, check.Name+" reports OK")
+		} else {
+			AddSummaryFinding(errorLevel, apiArea, check.Name+" reports "+value+" - see api/ping.json")
+		}
+	}
+	return nil
+}
+
+// extractZipArchive extracts a zip file into the target directory, skipping any entries that would be written
+// outside it
+func extractZipArchive(archivePath string, targetDir string) error {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		name := filepath.Clean(entry.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			LogMessage(warningLevel, "Skipping unexpected path in support packet: "+entry.Name)
+			continue
+		}
+		destination := filepath.Join(targetDir, name)
+
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(destination, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return err
+		}
+
+		reader, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		file, err := os.Create(destination)
+		if err != nil {
+			reader.Close()
+			return err
+		}
+		_, err = io.Copy(file, reader)
+		file.Close()
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectOfficialSupportPacket downloads the server's own support packet and merges its contents into ours, in the
+// support-packet directory.  The zip file itself is downloaded outside the temp directory, so that it isn't included.
+func collectOfficialSupportPacket(client *serverAPIClient, apiDir string) error {
+	download, err := os.CreateTemp("", "mm-support-packet-*.zip")
+	if err != nil {
+		return err
+	}
+	downloadPath := download.Name()
+	download.Close()
+	defer os.Remove(downloadPath)
+
+	if err := client.saveToFile("/api/v4/system/support_packet", supportPacketTimeout, downloadPath); err != nil {
+		return err
+	}
+	return extractZipArchive(downloadPath, apiDir+"/support-packet")
+}
+
+// collectServerLogs fetches the most recent entries from the server's log via the API, writing one entry per line to
+// server-logs.txt.  This is the server's view of its own log, which may differ from the files on disk if file logging
+// has been redirected.
+func collectServerLogs(client *serverAPIClient, apiDir string) error {
+	body, err := client.get(fmt.Sprintf("/api/v4/logs?page=0&logs_per_page=%d", apiLogsPerPage), apiRequestTimeout)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var entries []string
+	if err := json.NewDecoder(body).Decode(&entries); err != nil {
+		return err
+	}
+
+	file, err := os.Create(apiDir + "/server-logs.txt")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, entry := range entries {
+		fmt.Fprintln(file, strings.TrimRight(entry, "\n"))
+	}
+	return nil
+}
+
+// collectClusterStatus fetches the status of every node in the cluster, writing it to cluster-status.json, and reports
+// any nodes running a different version or configuration to the others
+func collectClusterStatus(client *serverAPIClient, apiDir string) error {
+	body, err := client.get("/api/v4/cluster/status", apiRequestTimeout)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(apiDir+"/cluster-status.json", content, 0644); err != nil {
+		return err
+	}
+
+	var nodes []apiClusterNode
+	if err := json.Unmarshal(content, &nodes); err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	AddSummaryFinding(infoLevel, apiArea, fmt.Sprintf("The cluster has %d nodes", len(nodes)))
+
+	versions := make(map[string]bool)
+	configHashes := make(map[string]bool)
+	for _, node := range nodes {
+		versions[node.Version] = true
+		configHashes[node.ConfigHash] = true
+	}
+	if len(versions) > 1 {
+		AddSummaryFinding(errorLevel, apiArea, "Cluster nodes are running different versions of Mattermost - see api/cluster-status.json")
+	}
+	if len(configHashes) > 1 {
+		AddSummaryFinding(warningLevel, apiArea, "Cluster nodes have different configurations - see api/cluster-status.json")
+	}
+	return nil
+}
+
+// ProbeServerAPI queries the REST API of a Mattermost server running on the local ListenPort, for instances that are
+// degraded rather than failing to start.  The ping endpoint (with get_server_status) is always queried, which reports
+// the health of the database and file store.  If a personal access token is supplied (from a user with the
+// manage_system permission), the server's own support packet is downloaded and merged into ours, and the server log
+// and cluster status are also fetched.  The token is only ever sent to the local server - it's never written to the
+// support packet.
+// The parsed config, the access token (which may be empty) and the temp directory are passed as parameters, and the
+// function returns an error object (nil on success).
+// The responses are written to the api directory in the temp directory, with the official support packet's contents
+// in api/support-packet.
+func ProbeServerAPI(config *mmConfig, token string, targetDir string) error {
+	DebugPrint("Probing server API - writing to: " + targetDir)
+
+	apiDir := targetDir + "/api"
+	if err := os.MkdirAll(apiDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+apiDir)
+		return errors.New(err.Error())
+	}
+
+	client := newServerAPIClient(config, token)
+
+	if err := probeServerPing(client, apiDir); err != nil {
+		// If the server isn't responding to pings, there's no point trying anything else
+		AddSummaryFinding(warningLevel, apiArea, "The server isn't responding to API requests at "+client.baseURL)
+		return errors.New(err.Error())
+	}
+
+	if token == "" {
+		LogMessage(infoLevel, "No access token supplied (MM_SUP_API_TOKEN), so only the ping endpoint was queried")
+		return nil
+	}
+
+	LogMessage(infoLevel, "Downloading the server's support packet")
+	if err := collectOfficialSupportPacket(client, apiDir); err != nil {
+		LogMessage(warningLevel, "Failed to download the server's support packet: "+err.Error())
+		AddSummaryFinding(warningLevel, apiArea, "Unable to download the server's support packet: "+err.Error())
+	}
+
+	if err := collectServerLogs(client, apiDir); err != nil {
+		LogMessage(warningLevel, "Failed to fetch the server log: "+err.Error())
+	}
+
+	if err := collectClusterStatus(client, apiDir); err != nil {
+		LogMessage(warningLevel, "Failed to fetch the cluster status: "+err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+// Package main contains service manager detection, and the collectors for non-systemd service managers
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceArea is the area name used for summary findings relating to the service and its process
+const serviceArea = "Service"
+
+// The service managers we know how to collect information from
+const (
+	serviceManagerSystemd     = "systemd"
+	serviceManagerOpenRC      = "openrc"
+	serviceManagerSupervisord = "supervisord"
+	serviceManagerSysV        = "sysv"
+	serviceManagerNone        = "none"
+)
+
+// maxServiceLogBytes limits how much of a service's output log we collect
+const maxServiceLogBytes = 5 * 1024 * 1024
+
+// maxSyslogLines limits the number of Mattermost-related lines collected from the system log
+const maxSyslogLines = 5000
+
+// supervisordConfigPaths lists the locations of the supervisord config and its program includes
+var supervisordConfigPaths = []string{
+	"/etc/supervisord.conf",
+	"/etc/supervisor/supervisord.conf",
+	"/etc/supervisor/conf.d/*",
+	"/etc/supervisord.d/*",
+}
+
+// systemLogPaths lists the syslog files used by the various distros, in order of preference
+var systemLogPaths = []string{"/var/log/syslog", "/var/log/messages"}
+
+// commandExists returns true if the named command can be found on the PATH
+func commandExists(command string) bool {
+	_, err := exec.LookPath(command)
+	return err == nil
+}
+
+// baseServiceName strips the systemd unit suffix from the service name, as other service managers don't use it
+func baseServiceName(serviceName string) string {
+	return strings.TrimSuffix(serviceName, ".service")
+}
+
+// findSupervisordProgram returns the supervisord config files that define the given program
+func findSupervisordProgram(program string) []string {
+	header := regexp.MustCompile(`(?m)^\s*\[program:` + regexp.QuoteMeta(program) + `\]`)
+
+	var files []string
+	for _, path := range discoverConfigFiles(supervisordConfigPaths) {
+		content, err := os.ReadFile(path)
+		if err == nil && header.Match(content) {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// detectServiceManager works out which service manager is responsible for Mattermost.  On a systemd host we check
+// that the unit actually exists, as Mattermost may be run by supervisord (or an init script) even there.
+func detectServiceManager(serviceName string) string {
+	name := baseServiceName(serviceName)
+
+	if _, err := os.Stat("/run/systemd/system"); err == nil && commandExists("systemctl") {
+		properties, err := getSystemdProperties(serviceName, "LoadState")
+		if err == nil && properties["LoadState"] != "not-found" {
+			return serviceManagerSystemd
+		}
+		DebugPrint("systemd is running, but unit " + serviceName + " was not found")
+	}
+
+	if commandExists("supervisorctl") && len(findSupervisordProgram(name)) > 0 {
+		return serviceManagerSupervisord
+	}
+
+	if _, err := os.Stat("/etc/init.d/" + name); err == nil {
+		if _, err := os.Stat("/run/openrc"); err == nil || commandExists("rc-service") {
+			return serviceManagerOpenRC
+		}
+		return serviceManagerSysV
+	}
+
+	return serviceManagerNone
+}
+
+// tailFileToFile copies (up to) the last maxBytes of a file into the output file
+func tailFileToFile(path string, outputFile string, maxBytes int64) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxBytes {
+		if _, err := source.Seek(-maxBytes, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	content, err := io.ReadAll(io.LimitReader(source, maxBytes))
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(outputFile, content, 0644)
+}
+
+// captureSystemLogLines copies the most recent Mattermost-related lines from the system log.  This is where init
+// scripts typically send the service's output.
+func captureSystemLogLines(name string, outputFile string) error {
+	for _, path := range systemLogPaths {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+
+		var lines []string
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if strings.Contains(strings.ToLower(scanner.Text()), name) {
+				lines = append(lines, scanner.Text())
+				if len(lines) > maxSyslogLines {
+					lines = lines[1:]
+				}
+			}
+		}
+
+		return os.WriteFile(outputFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	}
+	return errors.New("no system log found")
+}
+
+// shellVariablePattern matches simple variable assignments in init scripts and OpenRC conf.d files
+var shellVariablePattern = regexp.MustCompile(`(?m)^\s*(output_log|error_log|LOGFILE|LOG_FILE|logfile)=["']?([^"'\s]+)`)
+
+// captureInitScriptLogs collects the output logs referenced by an init script or OpenRC conf.d file (e.g. OpenRC's
+// output_log/error_log), falling back to the Mattermost lines in the system log.
+func captureInitScriptLogs(definitionFiles []string, name string, serviceDir string) bool {
+	noErrors := true
+	captured := false
+
+	for _, definition := range definitionFiles {
+		content, err := os.ReadFile(definition)
+		if err != nil {
+			continue
+		}
+		for _, matches := range shellVariablePattern.FindAllStringSubmatch(string(content), -1) {
+			logFile := matches[2]
+			if strings.Contains(logFile, "$") {
+				continue
+			}
+			outputFile := serviceDir + "/" + strings.ReplaceAll(strings.TrimPrefix(logFile, "/"), "/", "_")
+			if err := tailFileToFile(logFile, outputFile, maxServiceLogBytes); err != nil {
+				LogMessage(warningLevel, "Failed to capture service log "+logFile+": "+err.Error())
+				noErrors = false
+			} else {
+				captured = true
+			}
+		}
+	}
+
+	if !captured {
+		if err := captureSystemLogLines(name, serviceDir+"/syslog.txt"); err != nil {
+			LogMessage(warningLevel, "Failed to capture Mattermost messages from the system log: "+err.Error())
+			noErrors = false
+		}
+	}
+
+	return noErrors
+}
+
+// gatherOpenRCService captures the status, init script, conf.d settings and output logs for an OpenRC service
+func gatherOpenRCService(name string, serviceDir string) bool {
+	noErrors := true
+
+	if err := runCommandToFile(serviceDir+"/status.txt", "rc-service", name, "status"); err != nil {
+		LogMessage(warningLevel, "Failed to generate output from rc-service: "+err.Error())
+		noErrors = false
+	}
+	if err := runCommandToFile(serviceDir+"/rc-status.txt", "rc-status", "--all"); err != nil {
+		DebugPrint("Failed to generate output from rc-status: " + err.Error())
+	}
+
+	definitionFiles := discoverConfigFiles([]string{"/etc/init.d/" + name, "/etc/conf.d/" + name})
+	captureConfigFiles(definitionFiles, serviceDir+"/definition")
+
+	if !captureInitScriptLogs(definitionFiles, name, serviceDir) {
+		noErrors = false
+	}
+
+	return noErrors
+}
+
+// gatherSysVService captures the status, init script, defaults and output logs for a SysV init service
+func gatherSysVService(name string, serviceDir string) bool {
+	noErrors := true
+
+	if err := runCommandToFile(serviceDir+"/status.txt", "/etc/init.d/"+name, "status"); err != nil {
+		LogMessage(warningLevel, "Failed to generate output from init script status: "+err.Error())
+		noErrors = false
+	}
+
+	definitionFiles := discoverConfigFiles([]string{"/etc/init.d/" + name, "/etc/default/" + name, "/etc/sysconfig/" + name})
+	captureConfigFiles(definitionFiles, serviceDir+"/definition")
+
+	if !captureInitScriptLogs(definitionFiles, name, serviceDir) {
+		noErrors = false
+	}
+
+	return noErrors
+}
+
+// gatherSupervisordService captures the status, program definition and stdout/stderr logs for a supervisord program
+func gatherSupervisordService(name string, serviceDir string) bool {
+	noErrors := true
+
+	if err := runCommandToFile(serviceDir+"/status.txt", "supervisorctl", "status", name); err != nil {
+		// supervisorctl returns a non-zero exit code when the program isn't running, which is still useful output
+		DebugPrint("supervisorctl status returned: " + err.Error())
+	}
+
+	captureConfigFiles(findSupervisordProgram(name), serviceDir+"/definition")
+
+	tailBytes := "-" + strconv.Itoa(maxServiceLogBytes)
+	if err := runCommandToFile(serviceDir+"/stdout.log", "supervisorctl", "tail", tailBytes, name, "stdout"); err != nil {
+		LogMessage(warningLevel, "Failed to capture stdout log from supervisorctl: "+err.Error())
+		noErrors = false
+	}
+	if err := runCommandToFile(serviceDir+"/stderr.log", "supervisorctl", "tail", tailBytes, name, "stderr"); err != nil {
+		LogMessage(warningLevel, "Failed to capture stderr log from supervisorctl: "+err.Error())
+		noErrors = false
+	}
+
+	return noErrors
+}
+
+// GatherServiceManagerInformation collects the status, service definition and recent output logs for Mattermost
+// from a non-systemd service manager (OpenRC, SysV init or supervisord).  systemd has its own, more detailed,
+// collectors (see GatherServiceMessages, CollectJournal, CaptureSystemdUnit and AnalyseRestartHistory).
+// The service manager, the name of the service and the temp directory are passed in as parameters and we return a
+// bool to indicate complete success (true) or failure of one or more steps (false).
+// The information is written to the service directory in the temp directory.
+func GatherServiceManagerInformation(serviceManager string, serviceName string, targetDir string) bool {
+	DebugPrint("Gathering " + serviceManager + " service information - writing to: " + targetDir)
+
+	serviceDir := targetDir + "/service"
+	if err := os.MkdirAll(serviceDir, 0755); err != nil {
+		LogMessage(warningLevel, "Failed to create directory: "+serviceDir)
+		return false
+	}
+
+	name := baseServiceName(serviceName)
+
+	switch serviceManager {
+	case serviceManagerOpenRC:
+		return gatherOpenRCService(name, serviceDir)
+	case serviceManagerSysV:
+		return gatherSysVService(name, serviceDir)
+	case serviceManagerSupervisord:
+		return gatherSupervisordService(name, serviceDir)
+	default:
+		LogMessage(warningLevel, "No service manager found for "+name+" - only process information will be collected")
+		AddSummaryFinding(warningLevel, serviceArea, "No systemd unit, init script or supervisord program was found for "+name+" - use --service if it has a different name")
+		return false
+	}
+}
+
+// RecordMattermostProcesses finds any running Mattermost server processes by their executable path, whatever is
+// managing them, and records their command line, working directory, owner, start time and parent process.  The
+// parent often reveals how Mattermost was started (e.g. supervisord, a container runtime or a user's shell).
+// The Mattermost directory and the temp directory are passed as parameters, and the function returns an error object
+// (nil on success).
+// The result is stored in service/process.txt.
+func RecordMattermostProcesses(mmDir string, targetDir string) error {
+	DebugPrint("Locating running Mattermost processes")
+
+	serviceDir := targetDir + "/service"
+	if err := os.MkdirAll(serviceDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+serviceDir)
+		return errors.New(err.Error())
+	}
+
+	file, err := os.Create(serviceDir + "/process.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for process information in "+serviceDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	pids := findMattermostProcesses(mmDir)
+	if len(pids) == 0 {
+		fmt.Fprintf(file, "No running Mattermost process found.\n")
+		AddSummaryFinding(warningLevel, serviceArea, "No running Mattermost process was found")
+		return nil
+	}
+
+	bootTime, err := systemBootTime()
+	if err != nil {
+		DebugPrint("Unable to determine boot time: " + err.Error())
+	}
+
+	for _, pid := range pids {
+		fmt.Fprintf(file, "PID:          %d\n", pid)
+		fmt.Fprintf(file, "Executable:   %s\n", readProcessExe(pid))
+		fmt.Fprintf(file, "Command Line: %s\n", readProcessCmdline(pid))
+		if cwd, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/cwd"); err == nil {
+			fmt.Fprintf(file, "Working Dir:  %s\n", cwd)
+		}
+		if uid, err := processUID(pid); err == nil {
+			fmt.Fprintf(file, "User:         %s (%s)\n", lookupUsername(uid), uid)
+		}
+		if stat, err := readProcStat(pid); err == nil {
+			if !bootTime.IsZero() {
+				started := processStartTime(stat, bootTime)
+				fmt.Fprintf(file, "Started:      %s (up %s)\n", started.Format(time.RFC3339), time.Since(started).Round(time.Second))
+			}
+			fmt.Fprintf(file, "State:        %s\n", stat.State)
+			if parent, err := readProcStat(stat.PPID); err == nil {
+				fmt.Fprintf(file, "Parent:       %d (%s) %s\n", stat.PPID, parent.Comm, readProcessCmdline(stat.PPID))
+			} else {
+				fmt.Fprintf(file, "Parent:       %d\n", stat.PPID)
+			}
+		}
+		if exe := readProcessExe(pid); exe != filepath.Join(mmDir, "bin", "mattermost") {
+			fmt.Fprintf(file, "NOTE:         Executable is outside the install directory (%s)\n", mmDir)
+		}
+		fmt.Fprintf(file, "\n")
+	}
+
+	if len(pids) > 1 {
+		AddSummaryFinding(warningLevel, serviceArea, fmt.Sprintf("%d Mattermost processes are running - check for duplicate services", len(pids)))
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+// Package main contains the summary report, which highlights the most important findings from all collectors
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// summaryFinding is a single issue identified by one of the collectors, which should be brought to the attention of
+// whoever is reviewing the support packet.
+type summaryFinding struct {
+	Level   LogLevel
+	Area    string
+	Message string
+}
+
+// summaryFindings holds all of the findings reported so far, in the order they were reported
+var summaryFindings []summaryFinding
+
+// AddSummaryFinding records a finding for inclusion in the summary report.  The area identifies the collector (or
+// component) that the finding relates to, e.g. "Reverse Proxy".
+func AddSummaryFinding(level LogLevel, area string, message string) {
+	DebugPrint("Summary finding [" + area + "]: " + message)
+	summaryFindings = append(summaryFindings, summaryFinding{Level: level, Area: area, Message: message})
+}
+
+// WriteSummary writes all of the findings reported by the collectors to summary.txt in the temp directory, grouped
+// by severity so that the most serious issues appear first.  It returns an error object (nil on success).
+func WriteSummary(targetDir string) error {
+	DebugPrint("Writing summary report to: " + targetDir)
+
+	file, err := os.Create(targetDir + "/summary.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create summary file in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "Support Packet Summary\n======================\n")
+	fmt.Fprintf(file, "Generated: %s\n\n", time.Now().Format(time.RFC3339))
+
+	if len(summaryFindings) == 0 {
+		fmt.Fprintf(file, "No issues were identified.\n")
+		return nil
+	}
+
+	for _, level := range []LogLevel{errorLevel, warningLevel, infoLevel} {
+		for _, finding := range summaryFindings {
+			if finding.Level == level {
+				fmt.Fprintf(file, "[%s] %s: %s\n", finding.Level, finding.Area, finding.Message)
+			}
+		}
+	}
+
+	return nil
+}
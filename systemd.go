@@ -0,0 +1,162 @@
+// Package main contains the collectors for the systemd unit that runs Mattermost
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// systemdArea is the area name used for summary findings relating to the systemd unit
+const systemdArea = "systemd"
+
+// recommendedLimitNOFILE is the open file limit recommended for the Mattermost service in the install documentation
+const recommendedLimitNOFILE = 49152
+
+// systemdUnitProperties lists the unit properties captured from `systemctl show`.  These cover who the service runs
+// as, its resource limits, how it is started and how it is restarted.
+var systemdUnitProperties = []string{
+	"Id", "LoadState", "ActiveState", "SubState", "UnitFileState", "FragmentPath", "DropInPaths",
+	"User", "Group", "WorkingDirectory", "ExecStart", "ExecStartPre", "ExecStartPost",
+	"Environment", "EnvironmentFiles", "LimitNOFILE", "LimitNOFILESoft", "LimitNPROC",
+	"Restart", "RestartUSec", "StartLimitBurst", "StartLimitIntervalUSec", "TimeoutStartUSec", "TimeoutStopUSec",
+	"Type", "After", "Requires", "Wants",
+}
+
+// getSystemdProperties runs `systemctl show` for the given unit and properties, returning the results as a map.  Note
+// that some properties (e.g. EnvironmentFiles) can appear more than once, in which case the values are joined with
+// newlines.
+func getSystemdProperties(serviceName string, properties ...string) (map[string]string, error) {
+	args := []string{"show", serviceName, "--no-pager"}
+	for _, property := range properties {
+		args = append(args, "-p", property)
+	}
+
+	cmd := exec.Command("systemctl", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		if existing, ok := values[key]; ok && existing != "" {
+			values[key] = existing + "\n" + value
+		} else {
+			values[key] = value
+		}
+	}
+
+	return values, nil
+}
+
+// writeSystemdProperties writes the unit properties to a file, in the same KEY=VALUE form used by `systemctl show`
+func writeSystemdProperties(outputFile string, properties map[string]string) error {
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	for _, property := range systemdUnitProperties {
+		for _, value := range strings.Split(properties[property], "\n") {
+			fmt.Fprintf(file, "%s=%s\n", property, value)
+		}
+	}
+
+	return nil
+}
+
+// checkSystemdProperties reports common unit misconfigurations in the summary: a missing unit, running as root and
+// an open file limit below the recommended value.
+func checkSystemdProperties(serviceName string, properties map[string]string) {
+	if properties["LoadState"] == "not-found" {
+		AddSummaryFinding(errorLevel, systemdArea, "Unit "+serviceName+" was not found - use --service if Mattermost runs under a different unit name")
+		return
+	}
+
+	if properties["User"] == "" || properties["User"] == "root" {
+		AddSummaryFinding(warningLevel, systemdArea, "Unit "+serviceName+" runs Mattermost as root - it should run as a dedicated user")
+	}
+
+	limit := properties["LimitNOFILE"]
+	if limit != "" && limit != "infinity" {
+		if value, err := strconv.ParseInt(limit, 10, 64); err == nil && value < recommendedLimitNOFILE {
+			AddSummaryFinding(warningLevel, systemdArea, fmt.Sprintf("Unit %s has LimitNOFILE=%d, below the recommended %d", serviceName, value, recommendedLimitNOFILE))
+		}
+	}
+}
+
+// CaptureSystemdUnit captures the definition of the Mattermost systemd unit: the unit file and drop-ins as systemd sees
+// them (`systemctl cat`), the effective properties (`systemctl show`), copies of the drop-in override files, and the
+// contents of any EnvironmentFile the unit loads.  These can contain secrets (e.g. MM_SQLSETTINGS_DATASOURCE), which
+// are masked along with everything else during obfuscation.
+// The name of the service and the temp directory are passed in as parameters and we return a bool to indicate complete
+// success (true) or failure of one or more steps (false).
+// The information is written to the systemd directory in the temp directory.
+func CaptureSystemdUnit(serviceName string, targetDir string) bool {
+	DebugPrint("Capturing systemd unit " + serviceName + " - writing to: " + targetDir)
+
+	noErrors := true
+
+	systemdDir := targetDir + "/systemd"
+	if err := os.MkdirAll(systemdDir, 0755); err != nil {
+		LogMessage(warningLevel, "Failed to create directory: "+systemdDir)
+		return false
+	}
+
+	if err := runCommandToFile(systemdDir+"/unit.txt", "systemctl", "cat", serviceName, "--no-pager"); err != nil {
+		LogMessage(warningLevel, "Failed to generate output from systemctl cat: "+err.Error())
+		noErrors = false
+	}
+
+	properties, err := getSystemdProperties(serviceName, systemdUnitProperties...)
+	if err != nil {
+		LogMessage(warningLevel, "Failed to generate output from systemctl show: "+err.Error())
+		return false
+	}
+
+	if err := writeSystemdProperties(systemdDir+"/properties.txt", properties); err != nil {
+		LogMessage(warningLevel, "Failed to write systemd unit properties: "+err.Error())
+		noErrors = false
+	}
+
+	checkSystemdProperties(serviceName, properties)
+
+	// Drop-in overrides are listed space-separated in DropInPaths
+	if dropIns := strings.Fields(properties["DropInPaths"]); len(dropIns) > 0 {
+		captureConfigFiles(dropIns, systemdDir+"/drop-ins")
+	}
+
+	// Each EnvironmentFiles entry looks like "/etc/default/mattermost (ignore_errors=no)".  A leading '-' in the
+	// unit file (meaning "ignore if missing") has already been converted into ignore_errors by systemd.
+	var environmentFiles []string
+	for _, entry := range strings.Split(properties["EnvironmentFiles"], "\n") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := os.Stat(fields[0]); err != nil {
+			LogMessage(warningLevel, "EnvironmentFile "+fields[0]+" is not readable: "+err.Error())
+			continue
+		}
+		environmentFiles = append(environmentFiles, fields[0])
+	}
+	if len(environmentFiles) > 0 {
+		captureConfigFiles(environmentFiles, systemdDir+"/environment-files")
+	}
+
+	return noErrors
+}
@@ -0,0 +1,373 @@
+// Package main contains the system facts collector, which records the kernel, sysctl and resource limit settings
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// systemArea is the area name used for summary findings relating to the kernel and system settings
+const systemArea = "System"
+
+// factSysctls are the kernel settings that affect Mattermost's ability to handle many connections and files, and its
+// memory allocation
+var factSysctls = []string{
+	"fs.file-max", "fs.file-nr", "fs.nr_open",
+	"net.core.somaxconn", "net.ipv4.tcp_max_syn_backlog", "net.ipv4.ip_local_port_range",
+	"net.ipv4.tcp_fin_timeout", "net.ipv4.tcp_tw_reuse",
+	"vm.overcommit_memory", "vm.overcommit_ratio", "vm.swappiness", "vm.max_map_count",
+	"kernel.pid_max", "kernel.threads-max",
+}
+
+// rawFactFiles are copied as they are into the system directory, alongside the facts document
+var rawFactFiles = map[string]string{
+	"/proc/cmdline":         "cmdline",
+	"/proc/uptime":          "uptime",
+	"/proc/loadavg":         "loadavg",
+	"/proc/swaps":           "swaps",
+	"/proc/version":         "version",
+	"/proc/cpuinfo":         "cpuinfo",
+	"/proc/pressure/cpu":    "pressure-cpu",
+	"/proc/pressure/memory": "pressure-memory",
+	"/proc/pressure/io":     "pressure-io",
+	"/sys/kernel/mm/transparent_hugepage/enabled": "transparent_hugepage-enabled",
+	"/sys/kernel/mm/transparent_hugepage/defrag":  "transparent_hugepage-defrag",
+	"/etc/security/limits.conf":                   "limits.conf",
+}
+
+// unameFacts holds the output of uname(2)
+type unameFacts struct {
+	Sysname  string `json:"sysname"`
+	Nodename string `json:"nodename"`
+	Release  string `json:"release"`
+	Version  string `json:"version"`
+	Machine  string `json:"machine"`
+}
+
+// swapDevice is a single entry from /proc/swaps
+type swapDevice struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	SizeBytes int64  `json:"size_bytes"`
+	UsedBytes int64  `json:"used_bytes"`
+	Priority  int    `json:"priority"`
+}
+
+// resourceLimit is a soft and hard limit from /proc/<pid>/limits
+type resourceLimit struct {
+	Soft  string `json:"soft"`
+	Hard  string `json:"hard"`
+	Units string `json:"units,omitempty"`
+}
+
+// pamLimit is an entry from limits.conf (or limits.d) that applies to the service user
+type pamLimit struct {
+	File   string `json:"file"`
+	Domain string `json:"domain"`
+	Type   string `json:"type"`
+	Item   string `json:"item"`
+	Value  string `json:"value"`
+}
+
+// systemFacts is the structured facts document
+type systemFacts struct {
+	Uname               unameFacts               `json:"uname"`
+	KernelCmdline       string                   `json:"kernel_cmdline"`
+	UptimeSeconds       float64                  `json:"uptime_seconds"`
+	LoadAverage         []float64                `json:"load_average"`
+	CPUs                int                      `json:"cpus"`
+	Sysctls             map[string]string        `json:"sysctls"`
+	SwapTotalBytes      int64                    `json:"swap_total_bytes"`
+	SwapFreeBytes       int64                    `json:"swap_free_bytes"`
+	SwapDevices         []swapDevice             `json:"swap_devices"`
+	TransparentHugepage map[string]string        `json:"transparent_hugepage"`
+	ServiceUser         string                   `json:"service_user,omitempty"`
+	ProcessID           int                      `json:"process_id,omitempty"`
+	ProcessLimits       map[string]resourceLimit `json:"process_limits,omitempty"`
+	PAMLimits           []pamLimit               `json:"pam_limits,omitempty"`
+}
+
+// utsnameString converts a field from syscall.Utsname, which is a NUL-terminated array of C chars, into a string.
+// C chars are signed on some architectures (e.g. amd64) and unsigned on others (e.g. arm, ppc64le, s390x), so the
+// field type varies.
+func utsnameString[T int8 | uint8](field [65]T) string {
+	var builder strings.Builder
+	for _, char := range field {
+		if char == 0 {
+			break
+		}
+		builder.WriteByte(byte(char))
+	}
+	return builder.String()
+}
+
+// sysctlPath converts a sysctl name into its path under /proc/sys, e.g. vm.swappiness => /proc/sys/vm/swappiness
+func sysctlPath(name string) string {
+	return "/proc/sys/" + strings.ReplaceAll(name, ".", "/")
+}
+
+// selectedOption returns the selected value from a sysfs option list, e.g. "madvise" from "always [madvise] never"
+func selectedOption(options string) string {
+	start := strings.Index(options, "[")
+	end := strings.Index(options, "]")
+	if start == -1 || end < start {
+		return options
+	}
+	return options[start+1 : end]
+}
+
+// readSwapDevices parses /proc/swaps, whose sizes are in kilobytes
+func readSwapDevices() []swapDevice {
+	content, err := os.ReadFile("/proc/swaps")
+	if err != nil {
+		return nil
+	}
+
+	var devices []swapDevice
+	for _, line := range strings.Split(string(content), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		device := swapDevice{Name: fields[0], Type: fields[1]}
+		size, _ := strconv.ParseInt(fields[2], 10, 64)
+		used, _ := strconv.ParseInt(fields[3], 10, 64)
+		device.SizeBytes, device.UsedBytes = size*1024, used*1024
+		device.Priority, _ = strconv.Atoi(fields[4])
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// readProcessLimits parses /proc/<pid>/limits.  The limit names contain spaces, so the columns are split by position
+// using the header, e.g. "Max open files            1024                 524288               files".
+func readProcessLimits(pid int) (map[string]resourceLimit, error) {
+	content, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/limits")
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(content), "\n")
+	softColumn := strings.Index(lines[0], "Soft Limit")
+	if softColumn == -1 {
+		return nil, errors.New("unexpected format in /proc/" + strconv.Itoa(pid) + "/limits")
+	}
+
+	limits := make(map[string]resourceLimit)
+	for _, line := range lines[1:] {
+		if len(line) <= softColumn {
+			continue
+		}
+		fields := strings.Fields(line[softColumn:])
+		if len(fields) < 2 {
+			continue
+		}
+		limit := resourceLimit{Soft: fields[0], Hard: fields[1]}
+		if len(fields) > 2 {
+			limit.Units = fields[2]
+		}
+		limits[strings.TrimSpace(line[:softColumn])] = limit
+	}
+	return limits, nil
+}
+
+// readPAMLimits returns the entries in limits.conf and limits.d that apply to the given user, either directly, via
+// one of their groups (@group) or via the wildcard (*)
+func readPAMLimits(account *user.User) []pamLimit {
+	groups := make(map[string]bool)
+	if groupIDs, err := account.GroupIds(); err == nil {
+		for _, groupID := range groupIDs {
+			if group, err := user.LookupGroupId(groupID); err == nil {
+				groups[group.Name] = true
+			}
+		}
+	}
+
+	files := []string{"/etc/security/limits.conf"}
+	if extra, err := filepath.Glob("/etc/security/limits.d/*.conf"); err == nil {
+		sort.Strings(extra)
+		files = append(files, extra...)
+	}
+
+	var limits []pamLimit
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			domain := fields[0]
+			if domain == account.Username || domain == "*" || (strings.HasPrefix(domain, "@") && groups[domain[1:]]) {
+				limits = append(limits, pamLimit{File: path, Domain: domain, Type: fields[1], Item: fields[2], Value: fields[3]})
+			}
+		}
+		file.Close()
+	}
+	return limits
+}
+
+// writeFactFile writes one of the raw fact files, logging a warning if it can't be written
+func writeFactFile(path string, content []byte) {
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		LogMessage(warningLevel, "Failed to write "+path+": "+err.Error())
+	}
+}
+
+// copyRawFactFiles copies the raw kernel and system files into the system directory, along with the sysctl values
+// and any limits.d files
+func copyRawFactFiles(facts *systemFacts, systemDir string) {
+	for source, name := range rawFactFiles {
+		if content, err := os.ReadFile(source); err == nil {
+			writeFactFile(filepath.Join(systemDir, name), content)
+		}
+	}
+	if extra, err := filepath.Glob("/etc/security/limits.d/*.conf"); err == nil {
+		for _, source := range extra {
+			if content, err := os.ReadFile(source); err == nil {
+				writeFactFile(filepath.Join(systemDir, "limits.d-"+filepath.Base(source)), content)
+			}
+		}
+	}
+
+	var sysctls strings.Builder
+	for _, name := range factSysctls {
+		if value, ok := facts.Sysctls[name]; ok {
+			fmt.Fprintf(&sysctls, "%s = %s\n", name, value)
+		}
+	}
+	writeFactFile(filepath.Join(systemDir, "sysctl.txt"), []byte(sysctls.String()))
+
+	uname := facts.Uname
+	writeFactFile(filepath.Join(systemDir, "uname.txt"), []byte(fmt.Sprintf("%s %s %s %s %s\n", uname.Sysname, uname.Nodename, uname.Release, uname.Version, uname.Machine)))
+}
+
+// checkSystemFacts reports settings known to cause problems for Mattermost in the summary
+func checkSystemFacts(facts *systemFacts) {
+	if facts.Sysctls["vm.overcommit_memory"] == "2" {
+		AddSummaryFinding(warningLevel, systemArea, "vm.overcommit_memory is 2 (strict), which can stop Mattermost from allocating memory even when plenty is free")
+	}
+	if fileMax, err := strconv.ParseInt(facts.Sysctls["fs.file-max"], 10, 64); err == nil && fileMax < recommendedLimitNOFILE {
+		AddSummaryFinding(warningLevel, systemArea, fmt.Sprintf("fs.file-max is %d, below the %d open files recommended for Mattermost", fileMax, recommendedLimitNOFILE))
+	}
+	if facts.SwapTotalBytes == 0 {
+		AddSummaryFinding(infoLevel, systemArea, "No swap is configured")
+	}
+	if len(facts.LoadAverage) > 0 && facts.CPUs > 0 && facts.LoadAverage[0] > float64(2*facts.CPUs) {
+		AddSummaryFinding(warningLevel, systemArea, fmt.Sprintf("The 1 minute load average is %.2f, more than twice the %d CPUs", facts.LoadAverage[0], facts.CPUs))
+	}
+	if limit, ok := facts.ProcessLimits["Max open files"]; ok {
+		if soft, err := strconv.ParseInt(limit.Soft, 10, 64); err == nil && soft < recommendedLimitNOFILE {
+			AddSummaryFinding(warningLevel, systemArea, fmt.Sprintf("The running Mattermost process has an open file limit of %d, below the recommended %d", soft, recommendedLimitNOFILE))
+		}
+	}
+}
+
+// CollectSystemFacts records the kernel and system settings that affect Mattermost: uname, the kernel command line,
+// uptime and load average, the relevant sysctls (file and connection limits, overcommit and the local port range),
+// swap and the transparent hugepage setting.  It also records the resource limits that apply to the user Mattermost
+// runs as: those of the running process (the limits that are actually in force), and the entries in limits.conf and
+// limits.d for that user.  Note that limits.conf only applies to login sessions - services started by systemd use the
+// unit's Limit* settings instead.
+// The service manager, the service name, the Mattermost directory and the temp directory are passed as parameters, and
+// the function returns an error object (nil on success).
+// The raw files are copied to the system directory in the temp directory, alongside a structured facts document
+// (facts.json).
+func CollectSystemFacts(serviceManager string, serviceName string, mmDir string, targetDir string) error {
+	DebugPrint("Collecting system facts - writing to: " + targetDir)
+
+	systemDir := targetDir + "/system"
+	if err := os.MkdirAll(systemDir, 0755); err != nil {
+		LogMessage(errorLevel, "Failed to create directory: "+systemDir)
+		return errors.New(err.Error())
+	}
+
+	facts := &systemFacts{CPUs: runtime.NumCPU(), Sysctls: make(map[string]string), TransparentHugepage: make(map[string]string)}
+
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err == nil {
+		facts.Uname = unameFacts{
+			Sysname:  utsnameString(uname.Sysname),
+			Nodename: utsnameString(uname.Nodename),
+			Release:  utsnameString(uname.Release),
+			Version:  utsnameString(uname.Version),
+			Machine:  utsnameString(uname.Machine),
+		}
+	}
+
+	facts.KernelCmdline, _ = readTrimmedFile("/proc/cmdline")
+	if uptime, err := readTrimmedFile("/proc/uptime"); err == nil {
+		if fields := strings.Fields(uptime); len(fields) > 0 {
+			facts.UptimeSeconds, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	if loadavg, err := readTrimmedFile("/proc/loadavg"); err == nil {
+		// The first three fields are the 1, 5 and 15 minute load averages
+		for index, field := range strings.Fields(loadavg) {
+			if index == 3 {
+				break
+			}
+			value, _ := strconv.ParseFloat(field, 64)
+			facts.LoadAverage = append(facts.LoadAverage, value)
+		}
+	}
+
+	for _, name := range factSysctls {
+		if value, err := readTrimmedFile(sysctlPath(name)); err == nil {
+			facts.Sysctls[name] = strings.Join(strings.Fields(value), " ")
+		}
+	}
+
+	if meminfo, err := readMeminfo(); err == nil {
+		facts.SwapTotalBytes, facts.SwapFreeBytes = meminfo["SwapTotal"], meminfo["SwapFree"]
+	}
+	facts.SwapDevices = readSwapDevices()
+
+	for _, setting := range []string{"enabled", "defrag"} {
+		if value, err := readTrimmedFile("/sys/kernel/mm/transparent_hugepage/" + setting); err == nil {
+			facts.TransparentHugepage[setting] = selectedOption(value)
+		}
+	}
+
+	// The limits that apply to the service user
+	if pids := findMattermostProcesses(mmDir); len(pids) > 0 {
+		facts.ProcessID = pids[0]
+		if limits, err := readProcessLimits(pids[0]); err == nil {
+			facts.ProcessLimits = limits
+		}
+	}
+	if account, err := determineServiceAccount(serviceManager, serviceName, mmDir); err == nil {
+		facts.ServiceUser = account.Name
+		if found, err := user.Lookup(account.Name); err == nil {
+			facts.PAMLimits = readPAMLimits(found)
+		}
+	}
+
+	copyRawFactFiles(facts, systemDir)
+	checkSystemFacts(facts)
+
+	content, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	if err := os.WriteFile(systemDir+"/facts.json", content, 0644); err != nil {
+		LogMessage(warningLevel, "Unable to write facts.json: "+err.Error())
+		return errors.New(err.Error())
+	}
+
+	return nil
+}
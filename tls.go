@@ -0,0 +1,277 @@
+// Package main contains the TLS certificate and listener health checks for the support packet
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// tlsDialTimeout limits how long we'll wait when connecting to a local listener
+	tlsDialTimeout = 5 * time.Second
+	// certificateExpiryWarningDays is the number of days before expiry at which we start warning about a certificate
+	certificateExpiryWarningDays = 30
+)
+
+// siteURLHostPort extracts the hostname and port from the SiteURL, defaulting the port based on the scheme.  Empty
+// strings are returned if the SiteURL isn't set or can't be parsed.
+func siteURLHostPort(siteURL string) (string, string) {
+	if siteURL == "" {
+		return "", ""
+	}
+	parsed, err := url.Parse(siteURL)
+	if err != nil || parsed.Hostname() == "" {
+		return "", ""
+	}
+
+	port := parsed.Port()
+	if port == "" {
+		if parsed.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	return parsed.Hostname(), port
+}
+
+// loadCertificateChain reads every certificate in a PEM file.  The first certificate is expected to be the leaf,
+// followed by any intermediates.
+func loadCertificateChain(path string) ([]*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return chain, nil
+}
+
+// writeCertificateDetails writes the details of a single certificate that are relevant for troubleshooting, and
+// warns about certificates that have expired or are close to expiry.
+func writeCertificateDetails(w io.Writer, index int, cert *x509.Certificate) {
+	// The subject and issuer are written in the same form as the PEM summaries (see summariseCertificate), rather than
+	// as DNs, which obfuscation would mask beyond use
+	subject := cert.Subject.CommonName
+	if subject == "" {
+		subject = "(no common name)"
+	}
+	fmt.Fprintf(w, "  [%d] Subject CN:  %s\n", index, subject)
+	fmt.Fprintf(w, "      Issuer:      %s\n", describeIssuer(cert))
+	fmt.Fprintf(w, "      Not Before:  %s\n", cert.NotBefore.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "      Not After:   %s\n", cert.NotAfter.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "      Key Type:    %s\n", describePublicKey(cert))
+	fmt.Fprintf(w, "      Signature:   %s\n", cert.SignatureAlgorithm.String())
+	fmt.Fprintf(w, "      Is CA:       %t\n", cert.IsCA)
+	if len(cert.DNSNames) > 0 {
+		fmt.Fprintf(w, "      DNS SANs:    %s\n", strings.Join(cert.DNSNames, ", "))
+	}
+	if len(cert.IPAddresses) > 0 {
+		var ips []string
+		for _, ip := range cert.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		fmt.Fprintf(w, "      IP SANs:     %s\n", strings.Join(ips, ", "))
+	}
+
+	now := time.Now()
+	daysRemaining := int(cert.NotAfter.Sub(now).Hours() / 24)
+	switch {
+	case now.After(cert.NotAfter):
+		fmt.Fprintf(w, "      WARNING:     Certificate EXPIRED %d days ago\n", -daysRemaining)
+	case now.Before(cert.NotBefore):
+		fmt.Fprintf(w, "      WARNING:     Certificate is NOT YET VALID\n")
+	case daysRemaining < certificateExpiryWarningDays:
+		fmt.Fprintf(w, "      WARNING:     Certificate expires in %d days\n", daysRemaining)
+	default:
+		fmt.Fprintf(w, "      Expires In:  %d days\n", daysRemaining)
+	}
+}
+
+// verifyCertificateChain checks that the leaf certificate chains to a trusted root using the supplied intermediates,
+// and that it is valid for the SiteURL hostname (if known).
+func verifyCertificateChain(w io.Writer, chain []*x509.Certificate, hostname string) {
+	leaf := chain[0]
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		fmt.Fprintf(w, "Chain Verification: unable to load system root certificates: %s\n", err.Error())
+		return
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		fmt.Fprintf(w, "Chain Verification: FAILED - %s\n", err.Error())
+	} else {
+		fmt.Fprintf(w, "Chain Verification: OK\n")
+	}
+
+	if hostname == "" {
+		fmt.Fprintf(w, "Hostname Check:     skipped (no SiteURL configured)\n")
+	} else if err := leaf.VerifyHostname(hostname); err != nil {
+		fmt.Fprintf(w, "Hostname Check:     FAILED - certificate is not valid for SiteURL host %s: %s\n", hostname, err.Error())
+	} else {
+		fmt.Fprintf(w, "Hostname Check:     OK - certificate is valid for SiteURL host %s\n", hostname)
+	}
+}
+
+// checkCertificateFiles validates the certificate and key configured in ServiceSettings.TLSCertFile/TLSKeyFile:
+// that the files can be read, that the key matches the certificate, and that the chain, expiry and SANs are valid.
+func checkCertificateFiles(w io.Writer, config *mmConfig, mmDir string, hostname string) {
+	fmt.Fprintf(w, "\nConfigured Certificate\n----------------------\n")
+
+	if config.UseLetsEncrypt {
+		fmt.Fprintf(w, "UseLetsEncrypt is enabled - certificates are managed by Let's Encrypt, not TLSCertFile/TLSKeyFile.\n")
+		return
+	}
+
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		fmt.Fprintf(w, "ERROR: ConnectionSecurity is TLS, but TLSCertFile and/or TLSKeyFile is not set!\n")
+		return
+	}
+
+	certFile := resolveMattermostPath(mmDir, config.TLSCertFile)
+	keyFile := resolveMattermostPath(mmDir, config.TLSKeyFile)
+	fmt.Fprintf(w, "Certificate File:   %s\n", certFile)
+	fmt.Fprintf(w, "Key File:           %s\n", keyFile)
+
+	chain, err := loadCertificateChain(certFile)
+	if err != nil {
+		fmt.Fprintf(w, "ERROR: Unable to load certificate file: %s\n", err.Error())
+		return
+	}
+
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		fmt.Fprintf(w, "Key Pair Check:     FAILED - %s\n", err.Error())
+	} else {
+		fmt.Fprintf(w, "Key Pair Check:     OK - private key matches certificate\n")
+	}
+
+	verifyCertificateChain(w, chain, hostname)
+
+	fmt.Fprintf(w, "\nCertificates in %s:\n", certFile)
+	for index, cert := range chain {
+		writeCertificateDetails(w, index, cert)
+	}
+}
+
+// checkTLSListener performs a TLS handshake with a local listener, recording the negotiated protocol details and
+// the certificates presented.  If nothing is listening, or the listener doesn't speak TLS, this is recorded instead.
+func checkTLSListener(w io.Writer, address string, serverName string) {
+	fmt.Fprintf(w, "\nTLS Handshake with %s\n", address)
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", len("TLS Handshake with ")+len(address)))
+
+	conn, err := net.DialTimeout("tcp", address, tlsDialTimeout)
+	if err != nil {
+		fmt.Fprintf(w, "Nothing listening: %s\n", err.Error())
+		return
+	}
+	conn.Close()
+
+	dialer := &net.Dialer{Timeout: tlsDialTimeout}
+	tlsConn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		// We're diagnosing the certificate, so we want to complete the handshake even if it isn't trusted
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		fmt.Fprintf(w, "Handshake FAILED: %s\n", err.Error())
+		return
+	}
+	defer tlsConn.Close()
+
+	state := tlsConn.ConnectionState()
+	fmt.Fprintf(w, "Server Name (SNI):  %s\n", serverName)
+	fmt.Fprintf(w, "Protocol Version:   %s\n", tls.VersionName(state.Version))
+	fmt.Fprintf(w, "Cipher Suite:       %s\n", tls.CipherSuiteName(state.CipherSuite))
+	if state.NegotiatedProtocol != "" {
+		fmt.Fprintf(w, "ALPN Protocol:      %s\n", state.NegotiatedProtocol)
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		fmt.Fprintf(w, "WARNING: No certificates presented by the server\n")
+		return
+	}
+
+	verifyCertificateChain(w, state.PeerCertificates, serverName)
+
+	fmt.Fprintf(w, "\nCertificates presented by the server:\n")
+	for index, cert := range state.PeerCertificates {
+		writeCertificateDetails(w, index, cert)
+	}
+}
+
+// CheckTLSConfiguration examines the TLS setup of the Mattermost instance.  If Mattermost terminates TLS itself
+// (ServiceSettings.ConnectionSecurity is "TLS"), the configured certificate and key are validated and a handshake is
+// performed with the ListenPort.  If the SiteURL uses https but Mattermost doesn't terminate TLS, we assume that a
+// reverse proxy does, and perform a handshake with the local proxy instead.
+// The function takes the parsed config, the Mattermost directory and the temp directory as parameters, and returns
+// an error object (nil on success).
+// The result is stored in tls.txt.
+func CheckTLSConfiguration(config *mmConfig, mmDir string, targetDir string) error {
+	DebugPrint("Checking TLS configuration - writing to: " + targetDir)
+
+	file, err := os.Create(targetDir + "/tls.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for TLS information in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	hostname, sitePort := siteURLHostPort(config.SiteURL)
+	terminatesTLS := strings.EqualFold(config.ConnectionSecurity, "TLS")
+
+	fmt.Fprintf(file, "TLS Configuration\n=================\n")
+	fmt.Fprintf(file, "ConnectionSecurity: %s\n", config.ConnectionSecurity)
+	fmt.Fprintf(file, "SiteURL:            %s\n", config.SiteURL)
+	fmt.Fprintf(file, "ListenPort:         %s\n", config.ListenPort)
+
+	if terminatesTLS {
+		checkCertificateFiles(file, config, mmDir, hostname)
+		checkTLSListener(file, net.JoinHostPort("127.0.0.1", config.ListenPort), hostname)
+	} else if strings.HasPrefix(strings.ToLower(config.SiteURL), "https://") {
+		fmt.Fprintf(file, "\nMattermost is not terminating TLS, but the SiteURL uses https - TLS is expected to be terminated by a reverse proxy.\n")
+		checkTLSListener(file, net.JoinHostPort("127.0.0.1", sitePort), hostname)
+	} else {
+		fmt.Fprintf(file, "\nTLS is not in use.\n")
+	}
+
+	return nil
+}
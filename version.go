@@ -0,0 +1,308 @@
+// Package main contains the version collector, which identifies the installed Mattermost binary and its build
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// versionArea is the area name used for summary findings relating to the installed version
+const versionArea = "Version"
+
+// versionCommandTimeout limits how long we'll wait for `mattermost version`.  Some versions connect to the database to
+// report its schema version, which may hang if the database is unreachable.
+const versionCommandTimeout = 30 * time.Second
+
+// buildFlagPattern extracts the build metadata that Mattermost's Makefile injects into the model package with -X
+// linker flags, e.g. -X "github.com/mattermost/mattermost/server/public/model.BuildHash=abc123"
+var buildFlagPattern = regexp.MustCompile(`-X\s*['"]?[^\s='"]*/model\.(Build\w+)=('[^']*'|"[^"]*"|[^\s'"]*)`)
+
+// startupVersionPattern matches the line Mattermost logs each time it starts, e.g. "Current version is 9.11.1 (...)"
+var startupVersionPattern = regexp.MustCompile(`Current version is (\d+\.\d+\.\d+)`)
+
+// schemaVersionPattern matches the database schema version in the server's own support packet.  Older servers write
+// "database_schema_version" to support_packet.yaml, and newer ones "schema_version" under "database" in
+// diagnostics.yaml.
+var schemaVersionPattern = regexp.MustCompile(`(?m)^\s*(?:database_)?schema_version:\s*['"]?([^'"\s]+)`)
+
+// versionNumberPattern extracts the release number from a version, ignoring any suffix such as "-rc1"
+var versionNumberPattern = regexp.MustCompile(`^\d+\.\d+\.\d+`)
+
+// mattermostBuild holds everything we've learned about the installed binary
+type mattermostBuild struct {
+	Version         string
+	BuildNumber     string
+	BuildDate       string
+	BuildHash       string
+	EnterpriseReady string
+	DBVersion       string
+	GoVersion       string
+}
+
+// edition converts the BuildEnterpriseReady flag into the name of the edition
+func (b *mattermostBuild) edition() string {
+	switch b.EnterpriseReady {
+	case "true":
+		return "Enterprise Edition"
+	case "false":
+		return "Team Edition"
+	default:
+		return "unknown edition"
+	}
+}
+
+// runVersionCommand runs `mattermost version`, which prints the build details without starting the server.  File
+// logging is disabled via the environment, and if we're root the command is run as the binary's owner, so that it
+// can't leave root-owned log files behind that would stop the server from starting.
+func runVersionCommand(binary string, mmDir string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, binary, "version")
+	cmd.Dir = mmDir
+	cmd.Env = append(os.Environ(), "MM_LOGSETTINGS_ENABLEFILE=false", "MM_NOTIFYLOGSETTINGS_ENABLEFILE=false")
+	if info, err := os.Stat(binary); err == nil && os.Geteuid() == 0 {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: stat.Uid, Gid: stat.Gid}}
+		}
+	}
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return string(output), errors.New("timed out after " + versionCommandTimeout.String())
+	}
+	return string(output), err
+}
+
+// parseVersionOutput reads the "Name: value" lines printed by `mattermost version` into the build details
+func parseVersionOutput(output string, build *mattermostBuild) {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		name, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(name) {
+		case "Version":
+			build.Version = value
+		case "Build Number":
+			build.BuildNumber = value
+		case "Build Date":
+			build.BuildDate = value
+		case "Build Hash":
+			build.BuildHash = value
+		case "Build Enterprise Ready":
+			build.EnterpriseReady = value
+		case "DB Version":
+			build.DBVersion = value
+		}
+	}
+}
+
+// writeEmbeddedBuildInfo reads the build information the Go toolchain embeds in the binary, which doesn't require
+// running it.  Any build details not already known from `mattermost version` are filled in from the linker flags.
+func writeEmbeddedBuildInfo(w io.Writer, binary string, build *mattermostBuild) {
+	info, err := buildinfo.ReadFile(binary)
+	if err != nil {
+		fmt.Fprintf(w, "Unable to read embedded build info: %s\n", err.Error())
+		return
+	}
+
+	build.GoVersion = info.GoVersion
+	fmt.Fprintf(w, "Go Version:  %s\n", info.GoVersion)
+	fmt.Fprintf(w, "Module:      %s %s\n", info.Main.Path, info.Main.Version)
+	for _, setting := range info.Settings {
+		if setting.Key != "-ldflags" {
+			fmt.Fprintf(w, "%-12s %s\n", setting.Key+":", setting.Value)
+			continue
+		}
+
+		for _, matches := range buildFlagPattern.FindAllStringSubmatch(setting.Value, -1) {
+			value := strings.Trim(matches[2], `'"`)
+			fmt.Fprintf(w, "%-12s %s\n", matches[1]+":", value)
+			switch matches[1] {
+			case "BuildNumber":
+				if build.BuildNumber == "" {
+					build.BuildNumber = value
+				}
+			case "BuildDate":
+				if build.BuildDate == "" {
+					build.BuildDate = value
+				}
+			case "BuildHash":
+				if build.BuildHash == "" {
+					build.BuildHash = value
+				}
+			case "BuildEnterpriseReady":
+				if build.EnterpriseReady == "" {
+					build.EnterpriseReady = value
+				}
+			}
+		}
+	}
+}
+
+// lastStartedVersion returns the version Mattermost reported the last time it started, from the server log.  The
+// config file doesn't record the version, so the log is our only record of what was running before.
+func lastStartedVersion(logDirectory string) string {
+	file, err := os.Open(logDirectory + "/mattermost.log")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	version := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.Contains(line, []byte("Current version is")) {
+			continue
+		}
+		if matches := startupVersionPattern.FindSubmatch(line); matches != nil {
+			version = string(matches[1])
+		}
+	}
+	return version
+}
+
+// CollectMattermostVersion identifies the installed Mattermost binary: its version, edition, build hash and build
+// date.  These come from `mattermost version` (run with a timeout, and without starting the server), and from the
+// build info embedded in the binary, which is read directly and so still works if the binary won't run.  Neither
+// these nor the config file record the database schema version, which is added later by RecordDatabaseSchemaVersion
+// if the API probe collected it.  The config file doesn't record which version last ran either, so the binary's
+// version is compared with the version Mattermost last started with, from the server log, to detect an upgrade that's
+// in progress or failed part-way.
+// The parsed config, the Mattermost directory and the temp directory are passed as parameters, and the function
+// returns the installed version (empty if it couldn't be determined) and an error object (nil on success).
+// The result is written to version.txt in the temp directory.
+func CollectMattermostVersion(config *mmConfig, mmDir string, targetDir string) (string, error) {
+	DebugPrint("Collecting Mattermost version - writing to: " + targetDir)
+
+	binary := mmDir + "/bin/mattermost"
+	info, err := os.Stat(binary)
+	if err != nil {
+		LogMessage(warningLevel, "Mattermost binary not found at: "+binary)
+		AddSummaryFinding(errorLevel, versionArea, "The Mattermost binary is missing from "+binary)
+		return "", errors.New(err.Error())
+	}
+
+	file, err := os.Create(targetDir + "/version.txt")
+	if err != nil {
+		LogMessage(errorLevel, "Unable to create file for version information in "+targetDir)
+		return "", errors.New(err.Error())
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "Mattermost Version\n==================\n")
+	fmt.Fprintf(file, "Binary:      %s\n", binary)
+	fmt.Fprintf(file, "Size:        %s\n", formatBytes(info.Size()))
+	fmt.Fprintf(file, "Modified:    %s\n", info.ModTime().Format(time.RFC3339))
+	fmt.Fprintf(file, "Mode:        %s\n", info.Mode().String())
+
+	build := &mattermostBuild{}
+
+	fmt.Fprintf(file, "\nOutput of 'mattermost version'\n------------------------------\n")
+	output, err := runVersionCommand(binary, mmDir)
+	fmt.Fprintf(file, "%s\n", strings.TrimSpace(output))
+	if err != nil {
+		fmt.Fprintf(file, "Command failed: %s\n", err.Error())
+		LogMessage(warningLevel, "Failed to run 'mattermost version': "+err.Error())
+	}
+	parseVersionOutput(output, build)
+
+	fmt.Fprintf(file, "\nEmbedded Build Info\n-------------------\n")
+	writeEmbeddedBuildInfo(file, binary, build)
+
+	if build.Version == "" {
+		build.Version = build.BuildNumber
+	}
+	lastVersion := lastStartedVersion(config.LogDirectory)
+
+	fmt.Fprintf(file, "\nSummary\n-------\n")
+	fmt.Fprintf(file, "Version:              %s\n", build.Version)
+	fmt.Fprintf(file, "Edition:              %s\n", build.edition())
+	fmt.Fprintf(file, "Build Hash:           %s\n", build.BuildHash)
+	fmt.Fprintf(file, "Build Date:           %s\n", build.BuildDate)
+	fmt.Fprintf(file, "Go Version:           %s\n", build.GoVersion)
+	// Current releases of `mattermost version` don't report the schema version, and it isn't in the config file
+	if build.DBVersion != "" {
+		fmt.Fprintf(file, "DB Schema Version:    %s\n", build.DBVersion)
+	} else {
+		fmt.Fprintf(file, "DB Schema Version:    not available from the binary or config file (use --api with a token to collect it from the server)\n")
+	}
+	// The config file doesn't record which version last ran, so the server log is used instead
+	if lastVersion != "" {
+		fmt.Fprintf(file, "Last Started Version: %s (from mattermost.log)\n", lastVersion)
+	} else {
+		fmt.Fprintf(file, "Last Started Version: not found in mattermost.log\n")
+	}
+
+	if build.Version == "" {
+		AddSummaryFinding(warningLevel, versionArea, "Unable to determine the installed Mattermost version - see version.txt")
+		return "", nil
+	}
+	AddSummaryFinding(infoLevel, versionArea, fmt.Sprintf("Mattermost %s (%s) is installed", build.Version, build.edition()))
+
+	// Development builds may not have a release number, in which case there's nothing to compare
+	installedVersion := versionNumberPattern.FindString(build.Version)
+	if lastVersion != "" && installedVersion != "" && installedVersion != lastVersion {
+		AddSummaryFinding(warningLevel, versionArea, fmt.Sprintf("The installed binary is version %s, but Mattermost last started as version %s - an upgrade may be in progress or may have failed", build.Version, lastVersion))
+	}
+
+	return build.Version, nil
+}
+
+// RecordDatabaseSchemaVersion adds the database schema version to version.txt, from the server's own support packet
+// collected by the API probe (see ProbeServerAPI).  This is the only source of the schema version, as it's in neither
+// the binary nor the config file.
+// The temp directory is passed as a parameter, and the function returns an error object (nil on success).
+// The result is appended to version.txt in the temp directory.
+func RecordDatabaseSchemaVersion(targetDir string) error {
+	DebugPrint("Recording database schema version from: " + targetDir + "/api/support-packet")
+
+	schemaVersion := ""
+	_ = filepath.WalkDir(targetDir+"/api/support-packet", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || schemaVersion != "" || !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".yaml") {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		if matches := schemaVersionPattern.FindSubmatch(content); matches != nil {
+			schemaVersion = string(matches[1])
+		}
+		return nil
+	})
+	if schemaVersion == "" {
+		DebugPrint("No database schema version found in the server's support packet")
+		return nil
+	}
+
+	file, err := os.OpenFile(targetDir+"/version.txt", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		LogMessage(errorLevel, "Unable to open version.txt in "+targetDir)
+		return errors.New(err.Error())
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "DB Schema Version:    %s (from the server's support packet)\n", schemaVersion)
+	AddSummaryFinding(infoLevel, versionArea, "The database schema version is "+schemaVersion)
+
+	return nil
+}